@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gopkg.in/go-playground/validator.v8"
+)
+
+// Entries added through the API have this as their provider
+const manualProvider = "manual"
+
+// ItemInput is the body of POST /api/v1/items and PUT /api/v1/items/:id
+type ItemInput struct {
+	Title       string `json:"title" binding:"required,max=500"`
+	Description string `json:"description" binding:"max=20000"`
+	Src         string `json:"src" binding:"required,url"`
+}
+
+// ItemPatch is the body of PATCH /api/v1/items/:id, fields left out are kept
+type ItemPatch struct {
+	Title       *string `json:"title" binding:"omitempty,min=1,max=500"`
+	Description *string `json:"description" binding:"omitempty,max=20000"`
+	Src         *string `json:"src" binding:"omitempty,url"`
+}
+
+// Binds the JSON body to obj, answering 400 with what's wrong if it can't
+func bindItem(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindWith(obj, binding.JSON)
+	if err == nil {
+		return true
+	}
+
+	message := "Error occurred when parsing your JSON ! X( "
+	if errs, ok := err.(validator.ValidationErrors); ok {
+		var problems []string
+		for _, e := range errs {
+			field := strings.ToLower(e.Field)
+			switch e.Tag {
+			case "required":
+				problems = append(problems, field+" is required")
+			case "url":
+				problems = append(problems, field+" should be a URL")
+			case "min", "max":
+				problems = append(problems, fmt.Sprintf("%s should have a %s length of %s", field, e.Tag, e.Param))
+			default:
+				problems = append(problems, field+" is invalid")
+			}
+		}
+		sort.Strings(problems)
+		message = strings.Join(problems, ", ")
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"message": message})
+	return false
+}
+
+// Finds the entry of the :id param, answering 400 or 404 if there is none
+func (e *Env) findItem(c *gin.Context) (Data, bool) {
+	var data Data
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "id should be a positive number"})
+		return data, false
+	}
+
+	err = e.db.One("ID", id, &data)
+	if err == storm.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("No item %d", id)})
+		return data, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return data, false
+	}
+	return data, true
+}
+
+// Another entry already has the cover src, the API won't add it twice
+type duplicateSrcError struct {
+	id int
+}
+
+func (err duplicateSrcError) Error() string {
+	return fmt.Sprintf("Item %d has this src already", err.id)
+}
+
+// Fails with a duplicateSrcError if an entry other than id has src
+func checkSrc(tx storm.Node, src string, id int) error {
+	var same []Data
+	err := tx.Find("Src", src, &same)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, other := range same {
+		if other.ID != id {
+			return duplicateSrcError{other.ID}
+		}
+	}
+	return nil
+}
+
+// Downloads the cover at src into the store, unless data has it already, in
+// which case cover is nil
+func (e *Env) fetchCover(c *gin.Context, data Data, src string) (cover *ImageInfo, ok bool) {
+	if data.Src == src && data.Hash != "" {
+		return nil, true
+	}
+	// Don't download what would be refused
+	if err := checkSrc(e.db, src, data.ID); err != nil {
+		e.saveError(c, err)
+		return nil, false
+	}
+	info, err := fetchImages(c.Request.Context(), e.db, e.client, e.store, src)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": fmt.Sprintf("Can't download %s: %s", src, err)})
+		return nil, false
+	}
+	return &info, true
+}
+
+// Saves the entry id, or a new one if id is 0, and indexes it for search in
+// one transaction. The entry is read again in there and change applied to
+// it, so what a crawl changed since the request read it is kept. The cover
+// it had before is released, the sweep deletes it if nothing else uses it.
+func (e *Env) saveItem(id int, src string, cover *ImageInfo, change func(*Data)) (Data, error) {
+	var data Data
+	err := e.db.Bolt.Update(func(tx *bolt.Tx) error {
+		node := e.db.WithTransaction(tx)
+		if id != 0 {
+			if err := node.One("ID", id, &data); err != nil {
+				return err
+			}
+		}
+		oldHash := data.Hash
+		if cover != nil {
+			if err := checkSrc(node, src, id); err != nil {
+				return err
+			}
+			data.Src = src
+			data.Filename = getFilename(src)
+			data.Hash, data.Size, data.MIME = cover.Hash, cover.Size, cover.MIME
+		}
+		change(&data)
+
+		if err := node.Save(&data); err != nil {
+			return err
+		}
+		if err := keepCover(node, data.Hash); err != nil {
+			return err
+		}
+		if oldHash != data.Hash {
+			if err := releaseCover(node, oldHash); err != nil {
+				return err
+			}
+		}
+		if err := bumpChanges(node); err != nil {
+			return err
+		}
+		return indexDocument(tx, &data)
+	})
+	if err != nil && cover != nil {
+		// Nothing uses the cover just downloaded, let the sweep have it
+		if releaseErr := e.db.Bolt.Update(func(tx *bolt.Tx) error {
+			return releaseCover(e.db.WithTransaction(tx), cover.Hash)
+		}); releaseErr != nil {
+			logger.Warn("Can't release the cover", "hash", cover.Hash, "error", releaseErr)
+		}
+	}
+	return data, err
+}
+
+// Answers the error of saveItem or deleteItem, the entry may have been
+// deleted since it was read
+func (e *Env) saveError(c *gin.Context, err error) {
+	if _, ok := err.(duplicateSrcError); ok {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	if err == storm.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("No item %s", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+}
+
+func (e *Env) getItem(c *gin.Context) {
+	if data, ok := e.findItem(c); ok {
+		c.JSON(http.StatusOK, data)
+	}
+}
+
+// Add an entry by hand, its cover is downloaded right away
+func (e *Env) createItem(c *gin.Context) {
+	var input ItemInput
+	if !bindItem(c, &input) {
+		return
+	}
+
+	cover, ok := e.fetchCover(c, Data{}, input.Src)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	data, err := e.saveItem(0, input.Src, cover, func(data *Data) {
+		data.Title = input.Title
+		data.Description = input.Description
+		data.Provider = manualProvider
+		data.Curated = true
+		data.CreatedAt = now
+		data.UpdatedAt = now
+	})
+	if err != nil {
+		e.saveError(c, err)
+		return
+	}
+
+	c.Header("Location", fmt.Sprintf("%s/%d", c.Request.URL.Path, data.ID))
+	c.JSON(http.StatusCreated, data)
+}
+
+// Replace the title, description and cover of an entry. Crawls won't
+// overwrite them anymore.
+func (e *Env) replaceItem(c *gin.Context) {
+	data, ok := e.findItem(c)
+	if !ok {
+		return
+	}
+	var input ItemInput
+	if !bindItem(c, &input) {
+		return
+	}
+
+	e.updateItem(c, data, func(data *Data) {
+		data.Title = input.Title
+		data.Description = input.Description
+	}, input.Src)
+}
+
+// Change some fields of an entry, like replaceItem does
+func (e *Env) patchItem(c *gin.Context) {
+	data, ok := e.findItem(c)
+	if !ok {
+		return
+	}
+	var patch ItemPatch
+	if !bindItem(c, &patch) {
+		return
+	}
+
+	src := data.Src
+	if patch.Src != nil {
+		src = *patch.Src
+	}
+	e.updateItem(c, data, func(data *Data) {
+		if patch.Title != nil {
+			data.Title = *patch.Title
+		}
+		if patch.Description != nil {
+			data.Description = *patch.Description
+		}
+	}, src)
+}
+
+// data is the entry as it was read before the body, only its cover is looked
+// at to know whether src has to be downloaded
+func (e *Env) updateItem(c *gin.Context, data Data, change func(*Data), src string) {
+	cover, ok := e.fetchCover(c, data, src)
+	if !ok {
+		return
+	}
+	saved, err := e.saveItem(data.ID, src, cover, func(data *Data) {
+		change(data)
+		data.Curated = true
+		data.UpdatedAt = time.Now()
+	})
+	if err != nil {
+		e.saveError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, saved)
+}
+
+// Delete an entry, and its cover once the sweep finds nothing else uses it.
+// Crawled entries are remembered as dropped, so the next crawl doesn't bring
+// them back.
+func (e *Env) deleteItem(c *gin.Context) {
+	data, ok := e.findItem(c)
+	if !ok {
+		return
+	}
+
+	err := e.db.Bolt.Update(func(tx *bolt.Tx) error {
+		node := e.db.WithTransaction(tx)
+		// A crawl may have changed its cover since
+		if err := node.One("ID", data.ID, &data); err != nil {
+			return err
+		}
+		if err := node.DeleteStruct(&data); err != nil {
+			return err
+		}
+		if data.UpstreamKey != "" {
+			if err := node.Set(droppedBucket, data.UpstreamKey, time.Now()); err != nil {
+				return err
+			}
+		}
+		if err := releaseCover(node, data.Hash); err != nil {
+			return err
+		}
+		if err := bumpChanges(node); err != nil {
+			return err
+		}
+		return unindexDocument(tx, data.ID)
+	})
+	if err != nil {
+		e.saveError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
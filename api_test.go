@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The /api/v1/items routes of serve, without auth, and the URL of a server
+// with a cover for every path
+func newTestAPI(t *testing.T) (*Env, *gin.Engine, string) {
+	gin.SetMode(gin.TestMode)
+	images := newImageServer(t, nil)
+	e := &Env{
+		db:     newTestDB(t),
+		client: NewClient(5*time.Second, 0),
+		store:  NewLocalStore(t.TempDir()),
+	}
+	g := gin.New()
+	g.GET("/api/v1/items/:id", e.getItem)
+	g.POST("/api/v1/items", e.createItem)
+	g.PUT("/api/v1/items/:id", e.replaceItem)
+	g.PATCH("/api/v1/items/:id", e.patchItem)
+	g.DELETE("/api/v1/items/:id", e.deleteItem)
+	return e, g, images.URL
+}
+
+func do(g *gin.Engine, method, path, body string) (*httptest.ResponseRecorder, Data) {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var data Data
+	json.Unmarshal(w.Body.Bytes(), &data)
+	return w, data
+}
+
+func TestItems(t *testing.T) {
+	e, g, images := newTestAPI(t)
+
+	w, created := do(g, "POST", "/api/v1/items", `{"title": "Poster", "src": "`+images+`/1.png"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/v1/items/1" {
+		t.Fatalf("POST = %d at %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	if created.Hash == "" || created.MIME != "image/png" || !created.Curated || created.Provider != manualProvider {
+		t.Errorf("created %+v, want a curated manual entry with its cover", created)
+	}
+	if w, _ := do(g, "POST", "/api/v1/items", `{"title": "", "src": "nope"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST of an invalid body = %d, want 400", w.Code)
+	}
+
+	if w, got := do(g, "GET", "/api/v1/items/1", ""); w.Code != http.StatusOK || got.Title != "Poster" {
+		t.Errorf("GET = %d %+v", w.Code, got)
+	}
+
+	w, patched := do(g, "PATCH", "/api/v1/items/1", `{"description": "Big"}`)
+	if w.Code != http.StatusOK || patched.Title != "Poster" || patched.Description != "Big" || patched.Hash != created.Hash {
+		t.Errorf("PATCH = %d %+v, want the description changed and the rest kept", w.Code, patched)
+	}
+
+	w, replaced := do(g, "PUT", "/api/v1/items/1", `{"title": "Flyer", "src": "`+images+`/2.png"}`)
+	if w.Code != http.StatusOK || replaced.Title != "Flyer" || replaced.Description != "" || replaced.Hash == created.Hash {
+		t.Errorf("PUT = %d %+v, want everything replaced", w.Code, replaced)
+	}
+	if !orphaned(t, e.db, created.Hash) || orphaned(t, e.db, replaced.Hash) {
+		t.Error("the old cover isn't released, or the new one is")
+	}
+
+	if w, _ := do(g, "DELETE", "/api/v1/items/1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", w.Code)
+	}
+	if !orphaned(t, e.db, replaced.Hash) {
+		t.Error("the cover of the deleted entry isn't released")
+	}
+	for _, method := range []string{"GET", "PATCH", "PUT", "DELETE"} {
+		body := `{"title": "Gone", "src": "` + images + `/3.png"}`
+		if w, _ := do(g, method, "/api/v1/items/1", body); w.Code != http.StatusNotFound {
+			t.Errorf("%s of a deleted entry = %d, want 404", method, w.Code)
+		}
+	}
+	if w, _ := do(g, "GET", "/api/v1/items/x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET of a bad id = %d, want 400", w.Code)
+	}
+}
+
+func TestItemsConflict(t *testing.T) {
+	e, g, images := newTestAPI(t)
+	do(g, "POST", "/api/v1/items", `{"title": "One", "src": "`+images+`/1.png"}`)
+	do(g, "POST", "/api/v1/items", `{"title": "Two", "src": "`+images+`/2.png"}`)
+
+	w, _ := do(g, "POST", "/api/v1/items", `{"title": "Again", "src": "`+images+`/1.png"}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Item 1") {
+		t.Errorf("POST of a src there already = %d %s, want 409 naming item 1", w.Code, w.Body)
+	}
+	if w, _ := do(g, "PATCH", "/api/v1/items/2", `{"src": "`+images+`/1.png"}`); w.Code != http.StatusConflict {
+		t.Errorf("PATCH to the src of another entry = %d, want 409", w.Code)
+	}
+	if n, _ := e.db.Count(&Data{}); n != 2 {
+		t.Errorf("%d entries, want 2", n)
+	}
+
+	// Crawls may have the same src twice, that doesn't keep them from
+	// being edited
+	crawled := Data{Title: "Crawled", Provider: "test", UpstreamID: "1", Src: images + "/2.png"}
+	if err := upsert(e.db, &crawled); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := do(g, "PATCH", "/api/v1/items/2", `{"title": "Still two"}`); w.Code != http.StatusOK {
+		t.Errorf("PATCH of the title = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestSaveItemRereadsTheEntry(t *testing.T) {
+	e, g, images := newTestAPI(t)
+	_, created := do(g, "POST", "/api/v1/items", `{"title": "Poster", "src": "`+images+`/1.png"}`)
+
+	// A crawl changes the entry after the request read it
+	crawled := created
+	crawled.Hash = "crawled"
+	crawled.Metadata.Tags = []string{"print"}
+	if err := e.db.Save(&crawled); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := e.saveItem(created.ID, created.Src, nil, func(data *Data) { data.Title = "Renamed" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Title != "Renamed" || saved.Hash != "crawled" || len(saved.Tags) != 1 {
+		t.Errorf("saved %+v, want the title renamed and what the crawl changed kept", saved)
+	}
+
+	cover := &ImageInfo{Hash: "new", Size: 1, MIME: "image/png"}
+	if _, err := e.saveItem(created.ID, images+"/2.png", cover, func(*Data) {}); err != nil {
+		t.Fatal(err)
+	}
+	if !orphaned(t, e.db, "crawled") || orphaned(t, e.db, created.Hash) {
+		t.Error("the cover released isn't the one that was replaced")
+	}
+
+	// Deleted in the meantime, the cover just downloaded goes to the sweep
+	gone := &ImageInfo{Hash: "gone", Size: 1, MIME: "image/png"}
+	if _, err := e.saveItem(42, images+"/3.png", gone, func(*Data) {}); err == nil {
+		t.Error("saved an entry that isn't there")
+	}
+	if !orphaned(t, e.db, "gone") {
+		t.Error("the cover of an entry that's gone isn't released")
+	}
+}
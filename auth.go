@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes of API keys. A read key can only look, a write key can also change
+// entries, the log level and take backups.
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// Every key starts with it, so leaked keys are easy to grep for
+const apiKeyPrefix = "foli_"
+
+// Where authorize keeps the name of the key in the gin context
+const apiKeyName = "api_key"
+
+// APIKey is a key of the HTTP API. Only the sha256 of the key is stored, the
+// key itself is shown once when it's created.
+type APIKey struct {
+	ID   int    `storm:"increment" json:"id"`
+	Name string `storm:"unique" json:"name"`
+	// Hex sha256 of the key. Keys are never sent out, but storm stores them
+	// as JSON, with "-" the hash would only be kept in the index.
+	Hash  string `storm:"unique" json:"hash"`
+	Scope string `json:"scope"`
+	// The first characters of the key, to tell keys apart in the list
+	Hint      string    `json:"hint"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Whether the key may be used for what needs scope
+func (k *APIKey) Allows(scope string) bool {
+	return k.Scope == scopeWrite || k.Scope == scope
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Makes a key, stores its hash and returns the key
+func createAPIKey(db *storm.DB, name, scope string) (string, *APIKey, error) {
+	if scope != scopeRead && scope != scopeWrite {
+		return "", nil, fmt.Errorf("scope should be %s or %s, got \"%s\"", scopeRead, scopeWrite, scope)
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("keys need a name")
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+	k := &APIKey{
+		Name:      name,
+		Hash:      hashAPIKey(key),
+		Scope:     scope,
+		Hint:      key[:len(apiKeyPrefix)+6],
+		CreatedAt: time.Now(),
+	}
+	err := db.Save(k)
+	if err == storm.ErrAlreadyExists {
+		return "", nil, fmt.Errorf("there's a key named %s already", name)
+	}
+	return key, k, err
+}
+
+// The key sent with the request, as a bearer token or in X-API-Key
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			return strings.TrimSpace(auth[7:])
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// Refuses requests without a key allowing scope, when auth is enabled. The
+// name of the key ends up in the request log.
+func (e *Env) authorize(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !e.settings().authEnabled {
+			return
+		}
+
+		key := requestAPIKey(c.Request)
+		if key == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="foli"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "An API key is needed, as a bearer token or in X-API-Key"})
+			return
+		}
+		var k APIKey
+		err := e.db.One("Hash", hashAPIKey(key), &k)
+		if err == storm.ErrNotFound {
+			c.Header("WWW-Authenticate", `Bearer realm="foli", error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unknown or revoked API key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		c.Set(apiKeyName, k.Name)
+		l := requestLog(c).With("api_key", k.Name)
+		c.Request = c.Request.WithContext(withLog(c.Request.Context(), l))
+		if !k.Allows(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": fmt.Sprintf("The key %s is %s only", k.Name, k.Scope)})
+			return
+		}
+	}
+}
+
+// foli keys create|list|revoke, manages the API keys
+func keysCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	name := flags.String("name", "", "name of the key, e.g. who uses it")
+	scope := flags.String("scope", scopeRead, "read, or write to also change entries")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: foli keys create -name name [-scope read|write]
+       foli keys list
+       foli keys revoke <id or name>`)
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+
+	db := openDB(cfg)
+	defer db.Close()
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	switch command {
+	case "create":
+		key, k, err := createAPIKey(db, *name, *scope)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created the %s key %s (id %d), it won't be shown again:\n", k.Scope, k.Name, k.ID)
+		fmt.Println(key)
+	case "list":
+		var keys []APIKey
+		if err := db.All(&keys); err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPE\tKEY\tCREATED")
+		for _, k := range keys {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s...\t%s\n", k.ID, k.Name, k.Scope, k.Hint, k.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+	case "revoke":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		var k APIKey
+		var err error
+		if id, convErr := strconv.Atoi(flags.Arg(0)); convErr == nil {
+			err = db.One("ID", id, &k)
+		} else {
+			err = db.One("Name", flags.Arg(0), &k)
+		}
+		if err == storm.ErrNotFound {
+			log.Fatalf("There's no key %s\n", flags.Arg(0))
+		}
+		if err == nil {
+			err = db.DeleteStruct(&k)
+		}
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		fmt.Printf("Revoked the key %s (id %d)\n", k.Name, k.ID)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	db := newTestDB(t)
+	key, k, err := createAPIKey(db, "ci", scopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) != len(apiKeyPrefix)+64 || !strings.HasPrefix(key, k.Hint) {
+		t.Errorf("key %q with the hint %q", key, k.Hint)
+	}
+
+	// Only the hash is stored
+	var stored APIKey
+	if err := db.One("Name", "ci", &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Hash != hashAPIKey(key) || stored.Hash == key || strings.Contains(stored.Hash, key[len(apiKeyPrefix):]) {
+		t.Errorf("stored the hash %q for the key %q", stored.Hash, key)
+	}
+
+	if _, _, err := createAPIKey(db, "ci", scopeWrite); err == nil || !strings.Contains(err.Error(), "named ci") {
+		t.Errorf("a second key named ci: err = %v", err)
+	}
+	if _, _, err := createAPIKey(db, "admin", "root"); err == nil {
+		t.Error("made a key of the scope root")
+	}
+	other, _, err := createAPIKey(db, "other", scopeRead)
+	if err != nil || other == key {
+		t.Errorf("another key = %q, %v, want a new one", other, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := &Env{db: newTestDB(t)}
+	e.live.Store(&Settings{authEnabled: true})
+	readKey, _, err := createAPIKey(e.db, "reader", scopeRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey, _, err := createAPIKey(e.db, "writer", scopeWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, c.GetString(apiKeyName)) }
+	g.GET("/read", e.authorize(scopeRead), ok)
+	g.POST("/write", e.authorize(scopeWrite), ok)
+
+	for _, tt := range []struct {
+		method, path string
+		header, key  string
+		status       int
+	}{
+		{"GET", "/read", "", "", http.StatusUnauthorized},
+		{"GET", "/read", "Authorization", "Bearer foli_nope", http.StatusUnauthorized},
+		{"GET", "/read", "Authorization", "Bearer " + readKey, http.StatusOK},
+		{"GET", "/read", "Authorization", "bearer " + writeKey, http.StatusOK},
+		{"GET", "/read", "X-API-Key", readKey, http.StatusOK},
+		{"POST", "/write", "X-API-Key", readKey, http.StatusForbidden},
+		{"POST", "/write", "X-API-Key", writeKey, http.StatusOK},
+		// The hash isn't a key
+		{"GET", "/read", "X-API-Key", hashAPIKey(readKey), http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.key)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with %s %.20s: %d, want %d", tt.method, tt.path, tt.header, tt.key, w.Code, tt.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: 401 without WWW-Authenticate", tt.method, tt.path)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "reader" && w.Body.String() != "writer" {
+			t.Errorf("%s %s: the key name is %q", tt.method, tt.path, w.Body)
+		}
+	}
+
+	// Revoked keys stop working right away
+	var k APIKey
+	if err := e.db.One("Name", "reader", &k); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.db.DeleteStruct(&k); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/read", nil)
+	r.Header.Set("X-API-Key", readKey)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a revoked key: %d, want 401", w.Code)
+	}
+
+	// Auth off, anyone gets in
+	e.live.Store(&Settings{authEnabled: false})
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("POST", "/write", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("without auth: %d, want 200", w.Code)
+	}
+}
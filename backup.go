@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+	"github.com/gin-gonic/gin"
+)
+
+// Names in a backup archive, foli.db first then the covers under images/ by
+// their blob key
+const (
+	backupDBName    = "foli.db"
+	backupImagesDir = "images/"
+)
+
+var blobKeyPattern = regexp.MustCompile(`^sha256/([0-9a-f]{2})/([0-9a-f]{64})$`)
+
+// Copies foli.db to a temporary file in one read transaction, and lists the
+// covers its entries use. The copy is consistent even while crawls and edits
+// go on, and the transaction ends before anything is sent out, so a slow
+// reader doesn't keep it open.
+func snapshotDB(db *storm.DB) (path string, hashes []string, err error) {
+	tmp, err := ioutil.TempFile("", "foli-backup-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tmp.Close()
+
+	err = db.Bolt.View(func(tx *bolt.Tx) error {
+		if _, err := tx.WriteTo(tmp); err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		err := db.WithTransaction(tx).Select().Each(new(Data), func(record interface{}) error {
+			if hash := record.(*Data).Hash; hash != "" && !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+			return nil
+		})
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), hashes, nil
+}
+
+// Writes a gzipped tar of the snapshot at path and, if images, of the covers
+// with the given hashes. Covers deleted since the snapshot are left out.
+func writeBackup(w io.Writer, path string, hashes []string, store BlobStore, images bool) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = archive.WriteHeader(&tar.Header{Name: backupDBName, Mode: 0600, Size: stat.Size(), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(archive, f); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if !images {
+			break
+		}
+		if err := backupBlob(archive, store, blobKey(hash)); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func backupBlob(archive *tar.Writer, store BlobStore, key string) error {
+	blob, err := store.Get(key)
+	if err == ErrBlobNotFound {
+		logger.Warn("Cover is gone, leaving it out of the backup", "key", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if blob.Size() < 0 {
+		return fmt.Errorf("backup: the store doesn't know the size of %s", key)
+	}
+	err = archive.WriteHeader(&tar.Header{Name: backupImagesDir + key, Mode: 0644, Size: blob.Size(), ModTime: blob.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, blob)
+	return err
+}
+
+// Reads an archive of writeBackup. The covers go to store, foli.db to dbFile,
+// which is only replaced once everything else is read back.
+func readBackup(r io.Reader, dbFile string, store BlobStore) (restored int, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("restore: not a foli backup: %s", err)
+	}
+	archive := tar.NewReader(gz)
+
+	var dbTmp string
+	defer func() {
+		if dbTmp != "" {
+			os.Remove(dbTmp)
+		}
+	}()
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, err
+		}
+
+		switch {
+		case header.Name == backupDBName:
+			tmp, err := ioutil.TempFile(filepath.Dir(dbFile), ".restore-")
+			if err != nil {
+				return restored, err
+			}
+			dbTmp = tmp.Name()
+			_, err = io.Copy(tmp, archive)
+			if closeErr := tmp.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return restored, err
+			}
+		case strings.HasPrefix(header.Name, backupImagesDir):
+			key := strings.TrimPrefix(header.Name, backupImagesDir)
+			if err := restoreBlob(store, key, archive, header.Size); err != nil {
+				return restored, err
+			}
+			restored++
+		default:
+			logger.Warn("Skipping a file that isn't part of a foli backup", "name", header.Name)
+		}
+	}
+
+	if dbTmp == "" {
+		return restored, fmt.Errorf("restore: there's no %s in the backup", backupDBName)
+	}
+	if err := os.Chmod(dbTmp, 0600); err != nil {
+		return restored, err
+	}
+	if err := os.Rename(dbTmp, dbFile); err != nil {
+		return restored, err
+	}
+	dbTmp = ""
+	return restored, nil
+}
+
+// Covers already in the store are kept, the others have to match their hash
+func restoreBlob(store BlobStore, key string, r io.Reader, size int64) error {
+	m := blobKeyPattern.FindStringSubmatch(key)
+	if m == nil || m[1] != m[2][:2] {
+		return fmt.Errorf("restore: %s isn't a cover", key)
+	}
+	exists, err := store.Exists(key)
+	if err != nil || exists {
+		return err
+	}
+
+	hash := sha256.New()
+	body := bufio.NewReader(io.TeeReader(r, hash))
+	head, _ := body.Peek(512)
+	if err := store.Put(key, body, size, http.DetectContentType(head)); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != m[2] {
+		store.Delete(key)
+		return fmt.Errorf("restore: %s is corrupted, its content hashes to %s", key, sum)
+	}
+	return nil
+}
+
+// Download a backup of the running server, same as foli backup writes. Add
+// ?images=false to only get foli.db.
+func (e *Env) backup(c *gin.Context) {
+	path, hashes, err := snapshotDB(e.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	defer os.Remove(path)
+
+	name := fmt.Sprintf("foli-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	c.Status(http.StatusOK)
+	if err := writeBackup(c.Writer, path, hashes, e.store, c.Query("images") != "false"); err != nil {
+		// Too late to change the status, the client gets a broken archive
+		requestLog(c).Error("Backup failed halfway", "error", err)
+	}
+}
+
+// foli backup [-o file] [-images=false]
+func backupCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("o", fmt.Sprintf("foli-%s.tar.gz", time.Now().UTC().Format("20060102-150405")), "archive to write, - for stdout")
+	images := flags.Bool("images", true, "include the covers")
+	flags.Parse(args)
+
+	db := openDB(cfg)
+	defer db.Close()
+	path, hashes, err := snapshotDB(db)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	defer os.Remove(path)
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeBackup(w, path, hashes, newBlobStore(cfg), *images); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if *out != "-" {
+		covers := len(hashes)
+		if !*images {
+			covers = 0
+		}
+		fmt.Fprintf(os.Stderr, "Backed up %s and %d covers to %s\n", cfg.DB, covers, *out)
+	}
+}
+
+// foli restore [-force] file
+func restoreCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := flags.Bool("force", false, "replace the existing foli.db")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: foli restore [-force] backup.tar.gz")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if _, err := os.Stat(cfg.DB); err == nil {
+		if !*force {
+			log.Fatalf("%s exists, add -force to replace it\n", cfg.DB)
+		}
+		// Fails if foli is running
+		openDB(cfg).Close()
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	defer f.Close()
+	restored, err := readBackup(f, cfg.DB, newBlobStore(cfg))
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	fmt.Printf("Restored %s and %d covers from %s\n", cfg.DB, restored, flags.Arg(0))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+)
+
+// Stores content under its real hash
+func putCover(t *testing.T, store BlobStore, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	if err := store.Put(blobKey(hash), strings.NewReader(content), int64(len(content)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestBackupRestore(t *testing.T) {
+	db := newTestDB(t)
+	store := NewLocalStore(t.TempDir())
+	first, second := putCover(t, store, "first"), putCover(t, store, "second")
+	for i, hash := range []string{first, second, first} {
+		if err := db.Save(&Data{Title: strings.Repeat("x", i+1), Hash: hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, hashes, err := snapshotDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 {
+		t.Errorf("snapshot lists %d covers, want 2", len(hashes))
+	}
+	var archive bytes.Buffer
+	if err := writeBackup(&archive, path, hashes, store, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dbFile := filepath.Join(t.TempDir(), "foli.db")
+	restoredStore := NewLocalStore(t.TempDir())
+	restored, err := readBackup(bytes.NewReader(archive.Bytes()), dbFile, restoredStore)
+	if err != nil || restored != 2 {
+		t.Fatalf("restored %d covers, %v, want 2", restored, err)
+	}
+	for _, hash := range []string{first, second} {
+		if !blobExists(t, restoredStore, hash) {
+			t.Errorf("cover %s isn't restored", hash)
+		}
+	}
+	restoredDB, err := storm.Open(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoredDB.Close()
+	if n, err := restoredDB.Count(&Data{}); err != nil || n != 3 {
+		t.Errorf("restored %d entries, %v, want 3", n, err)
+	}
+
+	// Without the covers
+	archive.Reset()
+	if err := writeBackup(&archive, path, hashes, store, false); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := readBackup(&archive, filepath.Join(t.TempDir(), "foli.db"), NewLocalStore(t.TempDir())); err != nil || restored != 0 {
+		t.Errorf("restored %d covers, %v, want none", restored, err)
+	}
+}
+
+// A backup of an empty foli.db with one file added to it
+func backupWith(t *testing.T, name, content string) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for _, f := range [][2]string{{backupDBName, ""}, {name, content}} {
+		if err := archive.WriteHeader(&tar.Header{Name: f[0], Mode: 0600, Size: int64(len(f[1]))}); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write([]byte(f[1]))
+	}
+	archive.Close()
+	gz.Close()
+	return &buf
+}
+
+func TestRestoreChecksCovers(t *testing.T) {
+	sum := sha256.Sum256([]byte("cover"))
+	hash := hex.EncodeToString(sum[:])
+
+	for _, tt := range []struct {
+		name, content, err string
+	}{
+		{backupImagesDir + blobKey(hash), "not the cover", "corrupted"},
+		{backupImagesDir + "sha256/00/" + hash, "cover", "isn't a cover"},
+		{backupImagesDir + "sha256/../../escape", "cover", "isn't a cover"},
+	} {
+		dbFile := filepath.Join(t.TempDir(), "foli.db")
+		store := NewLocalStore(t.TempDir())
+		_, err := readBackup(backupWith(t, tt.name, tt.content), dbFile, store)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+		if blobExists(t, store, hash) {
+			t.Errorf("%s: the cover was kept", tt.name)
+		}
+		if _, err := os.Stat(dbFile); err == nil {
+			t.Errorf("%s: foli.db was replaced", tt.name)
+		}
+	}
+
+	if _, err := readBackup(strings.NewReader("not gzip"), filepath.Join(t.TempDir(), "foli.db"), NewLocalStore(t.TempDir())); err == nil {
+		t.Error("restored something that isn't a backup")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const behanceAPI = "https://api.behance.net/v2"
+
+// JSON parsing and accessing
+// https://github.com/astaxie/build-web-application-with-golang/blob/master/zh/07.2.md
+type CreativesSlice struct {
+	Creatives []Creative `json:"creatives_to_follow"`
+}
+
+type Creative struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type UserProjectsSlice struct {
+	Projects []UserProject `json:"projects"`
+}
+
+type UserProject struct {
+	ID int `json:"id"`
+}
+
+type Project struct {
+	Project ProjectParsed `json:"project"`
+}
+
+type ProjectParsed struct {
+	ID          int                    `json:"id"`
+	Title       string                 `json:"name"`
+	Description string                 `json:"description"`
+	Src         map[string]interface{} `json:"covers"`
+	Owners      behanceOwners          `json:"owners"`
+	Tags        []string               `json:"tags"`
+	Fields      []string               `json:"fields"`
+	PublishedOn int64                  `json:"published_on"`
+	ModifiedOn  int64                  `json:"modified_on"`
+	Stats       struct {
+		Views         int `json:"views"`
+		Appreciations int `json:"appreciations"`
+		Comments      int `json:"comments"`
+	} `json:"stats"`
+}
+
+type ProjectOwner struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+// Owners come as an array from /projects/:id but as an object keyed by user
+// ID from some other endpoints, both are accepted.
+type behanceOwners []ProjectOwner
+
+func (o *behanceOwners) UnmarshalJSON(b []byte) error {
+	var list []ProjectOwner
+	if err := json.Unmarshal(b, &list); err == nil {
+		*o = list
+		return nil
+	}
+	var byID map[string]ProjectOwner
+	if err := json.Unmarshal(b, &byID); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	*o = nil
+	for _, id := range ids {
+		*o = append(*o, byID[id])
+	}
+	return nil
+}
+
+// Behance talks to the /v2 endpoints of Behance.
+// https://www.behance.net/dev/api/endpoints/9
+type Behance struct {
+	apiKey string
+	client *Client
+}
+
+func NewBehance(apiKey string, client *Client) *Behance {
+	return &Behance{apiKey: apiKey, client: client}
+}
+
+func (b *Behance) Name() string { return "behance" }
+
+// Use endpoint /v2/creativestofollow to fetch a list of creatives to follow (user).
+// And, it accepts a parameter to do pagination.
+func (b *Behance) ListCreators(ctx context.Context, page int) ([]Creator, error) {
+	var userList CreativesSlice
+	if err := b.fetch(ctx, "creativestofollow", behanceAPI+"/creativestofollow", page, &userList); err != nil {
+		return nil, err
+	}
+
+	creators := make([]Creator, len(userList.Creatives))
+	for i, creative := range userList.Creatives {
+		creators[i] = Creator{ID: strconv.Itoa(creative.ID), Username: creative.Username}
+	}
+	return creators, nil
+}
+
+// Use endpoint /v2/users/:username to fetch a list of projects created by user.
+func (b *Behance) ListProjects(ctx context.Context, creator Creator) ([]string, error) {
+	var projectList UserProjectsSlice
+	if err := b.fetch(ctx, "users/projects", fmt.Sprintf("%s/users/%s/projects", behanceAPI, creator.Username), 1, &projectList); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(projectList.Projects))
+	for i, project := range projectList.Projects {
+		ids[i] = strconv.Itoa(project.ID)
+	}
+	return ids, nil
+}
+
+// Use endpoint /v2/projects/:id to fetch the cover and description needed.
+func (b *Behance) ResolveCover(ctx context.Context, projectID string) (Cover, error) {
+	var resource Project
+	if err := b.fetch(ctx, "projects", fmt.Sprintf("%s/projects/%s", behanceAPI, projectID), 1, &resource); err != nil {
+		return Cover{}, err
+	}
+
+	project := resource.Project
+	covers := make(map[string]string)
+	for size, url := range project.Src {
+		if s, ok := url.(string); ok && s != "" {
+			covers[size] = s
+		}
+	}
+	src := largestCover(covers)
+	if src == "" {
+		return Cover{}, fmt.Errorf("behance: project %s has no cover", projectID)
+	}
+
+	meta := Metadata{
+		Tags:          project.Tags,
+		Fields:        project.Fields,
+		Views:         project.Stats.Views,
+		Appreciations: project.Stats.Appreciations,
+		Comments:      project.Stats.Comments,
+		Covers:        covers,
+	}
+	for _, owner := range project.Owners {
+		meta.Owners = append(meta.Owners, Owner{
+			ID:          strconv.Itoa(owner.ID),
+			Username:    owner.Username,
+			DisplayName: owner.DisplayName,
+		})
+	}
+	if project.PublishedOn > 0 {
+		meta.PublishedAt = time.Unix(project.PublishedOn, 0).UTC()
+	}
+	if project.ModifiedOn > 0 {
+		meta.ModifiedAt = time.Unix(project.ModifiedOn, 0).UTC()
+	}
+
+	return Cover{
+		ProjectID:   projectID,
+		Title:       project.Title,
+		Description: project.Description,
+		Src:         src,
+		Metadata:    meta,
+	}, nil
+}
+
+// The original cover, or the widest one when there is no original
+func largestCover(covers map[string]string) string {
+	if src, ok := covers["original"]; ok {
+		return src
+	}
+	src, widest := "", -1
+	for size, url := range covers {
+		if width, err := strconv.Atoi(size); err == nil && width > widest {
+			src, widest = url, width
+		}
+	}
+	return src
+}
+
+// endpoint only labels the request in the client counters
+func (b *Behance) fetch(ctx context.Context, endpoint, url string, page int, dest interface{}) error {
+	urlWithPage := fmt.Sprintf("%s?page=%d&client_id=%s", url, page, b.apiKey)
+	return b.client.GetJSON(ctx, endpoint, urlWithPage, dest)
+}
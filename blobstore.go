@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore is where the covers are kept, keyed by their content address
+// (see blobKey). Several foli instances can share an S3 bucket instead of
+// each keeping its own images directory.
+type BlobStore interface {
+	// Put stores size bytes of r under key, the blob only becomes visible
+	// once all of it is written.
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob, it's an io.ReadSeeker too when the store can.
+	Get(key string) (Blob, error)
+	Exists(key string) (bool, error)
+	Delete(key string) error
+	// URL returns a link to fetch the blob directly for the given time,
+	// or "" if the store can't hand out links.
+	URL(key string, expires time.Duration) (string, error)
+}
+
+// Blob is an opened blob of a BlobStore
+type Blob interface {
+	io.ReadCloser
+	Size() int64
+	ModTime() time.Time
+}
+
+// Content addressed key of a blob, the same in every store. hash has to be
+// a validHash, anything else could point outside of the store.
+func blobKey(hash string) string {
+	return "sha256/" + hash[:2] + "/" + hash
+}
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Whether hash is the hex SHA-256 fetchImages gives covers
+func validHash(hash string) bool {
+	return hashPattern.MatchString(hash)
+}
+
+// LocalStore keeps blobs as files under a directory
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) *LocalStore {
+	return &LocalStore{root: root}
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+// Written to a temporary file first, then renamed, so readers never see a
+// half written blob.
+func (s *LocalStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".put-")
+	if err != nil {
+		return err
+	}
+	// Harmless once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *LocalStore) Get(key string) (Blob, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localBlob{File: f, info: info}, nil
+}
+
+func (s *LocalStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Local files are streamed by foli itself
+func (s *LocalStore) URL(key string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+type localBlob struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (b *localBlob) Size() int64        { return b.info.Size() }
+func (b *localBlob) ModTime() time.Time { return b.info.ModTime() }
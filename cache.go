@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/gin-gonic/gin"
+)
+
+// Changes counts the writes to the entries. It's kept in foli.db, so the
+// ETags made from it survive restarts.
+type Changes struct {
+	Counter uint64    `json:"counter"`
+	At      time.Time `json:"at"`
+}
+
+const changesKey = "changes"
+
+// Called in the transaction of every write to the entries
+func bumpChanges(tx storm.Node) error {
+	ch, err := loadChanges(tx)
+	if err != nil {
+		return err
+	}
+	ch.Counter++
+	ch.At = time.Now().UTC()
+	return tx.Set(metaBucket, changesKey, &ch)
+}
+
+func loadChanges(db storm.Node) (Changes, error) {
+	var ch Changes
+	err := db.Get(metaBucket, changesKey, &ch)
+	if err == storm.ErrNotFound {
+		return Changes{}, nil
+	}
+	return ch, err
+}
+
+// Weak, the same data may be encoded differently. The time tells apart two
+// databases that went through as many changes, e.g. after a restore.
+func (ch Changes) ETag() string {
+	if ch.At.IsZero() {
+		return `W/"0"`
+	}
+	return fmt.Sprintf(`W/"%d-%x"`, ch.Counter, ch.At.UnixNano())
+}
+
+func (ch Changes) same(other Changes) bool {
+	return ch.Counter == other.Counter && ch.At.Equal(other.At)
+}
+
+// Whether an If-None-Match lists etag, compared weakly
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Where conditional keeps the Changes the response is made from
+const changesName = "changes"
+
+// Tags the responses made from the entries with an ETag and Last-Modified
+// from the change counter, and answers 304 to GET and HEAD requests which
+// already have the current one.
+func (e *Env) conditional(c *gin.Context) {
+	ch, err := loadChanges(e.db)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.Set(changesName, ch)
+
+	etag := ch.ETag()
+	c.Header("ETag", etag)
+	// Caches may keep the response, but have to ask whether it changed
+	c.Header("Cache-Control", "no-cache")
+	if !ch.At.IsZero() {
+		c.Header("Last-Modified", ch.At.Format(http.TimeFormat))
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		return
+	}
+
+	if inm := c.Request.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			c.AbortWithStatus(http.StatusNotModified)
+		}
+		return
+	}
+	if ims := c.Request.Header.Get("If-Modified-Since"); ims != "" && !ch.At.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !ch.At.Truncate(time.Second).After(t) {
+			c.AbortWithStatus(http.StatusNotModified)
+		}
+	}
+}
+
+// POST bodies bigger than that aren't cached
+const maxCachedBody = 64 << 10
+
+// ResponseCache keeps the responses of the entry routes in memory until the
+// entries change, evicting the least recently used ones past its budget.
+// Each response is cached under its method, URL and body.
+type ResponseCache struct {
+	budget int64
+
+	mu      sync.Mutex
+	size    int64
+	changes Changes
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *cachedResponse) size() int64 {
+	return int64(len(r.key) + len(r.body))
+}
+
+func NewResponseCache(budget int64) *ResponseCache {
+	return &ResponseCache{
+		budget:  budget,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Drops everything once the entries changed, callers hold r.mu
+func (r *ResponseCache) sync(ch Changes) {
+	if !r.changes.same(ch) {
+		r.changes = ch
+		r.size = 0
+		r.order.Init()
+		r.entries = make(map[string]*list.Element)
+	}
+}
+
+func (r *ResponseCache) Get(key string, ch Changes) (*cachedResponse, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sync(ch)
+	el, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	r.order.MoveToFront(el)
+	return el.Value.(*cachedResponse), true
+}
+
+// The biggest response kept, so a few big ones don't evict everything else
+func (r *ResponseCache) maxEntry() int64 {
+	return r.budget / 4
+}
+
+// Stores resp if it was made from the latest changes seen
+func (r *ResponseCache) Put(resp *cachedResponse, ch Changes) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.changes.same(ch) || resp.size() > r.maxEntry() {
+		return
+	}
+	if el, ok := r.entries[resp.key]; ok {
+		r.size -= el.Value.(*cachedResponse).size()
+		r.order.Remove(el)
+	}
+	r.entries[resp.key] = r.order.PushFront(resp)
+	r.size += resp.size()
+
+	for r.size > r.budget && r.order.Len() > 0 {
+		el := r.order.Back()
+		old := el.Value.(*cachedResponse)
+		r.order.Remove(el)
+		delete(r.entries, old.key)
+		r.size -= old.size()
+	}
+}
+
+// Keeps a copy of what the handler writes, until it's more than limit and
+// too big to be cached anyway
+type teeWriter struct {
+	gin.ResponseWriter
+	buf   bytes.Buffer
+	limit int64
+	over  bool
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if !w.over {
+		if int64(w.buf.Len()+len(b)) > w.limit {
+			w.over = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Answers from the response cache when it has the response, goes after
+// conditional. Only 200s are cached, with the headers the handler set.
+func (e *Env) cached(c *gin.Context) {
+	cache := e.settings().cache
+	if cache == nil {
+		return
+	}
+	ch := c.MustGet(changesName).(Changes)
+
+	key := c.Request.Method + " " + c.Request.URL.RequestURI()
+	if c.Request.Body != nil && c.Request.Method == http.MethodPost {
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxCachedBody+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+		if len(body) > maxCachedBody {
+			return
+		}
+		key += "\n" + string(body)
+	}
+
+	if resp, ok := cache.Get(key, ch); ok {
+		httpCache.Inc("hit")
+		for name, values := range resp.header {
+			c.Writer.Header()[name] = values
+		}
+		c.Header("X-Cache", "hit")
+		c.Status(resp.status)
+		c.Writer.Write(resp.body)
+		c.Abort()
+		return
+	}
+	httpCache.Inc("miss")
+
+	before := c.Writer.Header()
+	seen := make(map[string]bool, len(before))
+	for name := range before {
+		seen[name] = true
+	}
+	tee := &teeWriter{ResponseWriter: c.Writer, limit: cache.maxEntry()}
+	c.Writer = tee
+	c.Next()
+	c.Writer = tee.ResponseWriter
+
+	if c.Writer.Status() != http.StatusOK || tee.over {
+		return
+	}
+	// Only what the handler set, the rest is up to the middlewares
+	header := make(http.Header)
+	for name, values := range c.Writer.Header() {
+		if !seen[name] && name != "Content-Encoding" && name != "Vary" {
+			header[name] = values
+		}
+	}
+	cache.Put(&cachedResponse{key: key, status: http.StatusOK, header: header, body: tee.buf.Bytes()}, ch)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCachedSkipsBigResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	e := &Env{}
+	e.live.Store(&Settings{cache: NewResponseCache(4096)})
+	ch := Changes{Counter: 1, At: time.Now()}
+
+	g := gin.New()
+	g.Use(func(c *gin.Context) { c.Set(changesName, ch) }, e.cached)
+	g.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "small") })
+	g.GET("/big", func(c *gin.Context) {
+		// Written in pieces, like the streamed JSON of GET /
+		for i := 0; i < 8; i++ {
+			c.Writer.WriteString(strings.Repeat("x", 512))
+		}
+	})
+
+	for _, tt := range []struct {
+		path   string
+		size   int
+		cached bool
+	}{
+		{"/small", 5, true},
+		{"/big", 4096, false},
+	} {
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Body.Len() != tt.size {
+				t.Fatalf("%s: body of %d bytes, want %d", tt.path, w.Body.Len(), tt.size)
+			}
+			if hit := w.Header().Get("X-Cache") == "hit"; i == 1 && hit != tt.cached {
+				t.Errorf("%s: served from the cache = %v, want %v", tt.path, hit, tt.cached)
+			}
+		}
+	}
+}
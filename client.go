@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults of the upstream client, http.timeout and http.retries override
+// the first two
+const (
+	defaultHTTPTimeout = 30 * time.Second
+	defaultHTTPRetries = 4
+	// First backoff delay, it doubles on every retry up to maxBackoff
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+	// Don't let a Retry-After park a worker for longer than this
+	maxRetryAfter = 2 * time.Minute
+)
+
+// StatusError is returned when upstream answers with a non 2xx status
+type StatusError struct {
+	Endpoint string
+	Code     int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: upstream responded %d %s", e.Endpoint, e.Code, http.StatusText(e.Code))
+}
+
+// Whether it's worth trying again, i.e. rate limited or a server error
+func (e *StatusError) Temporary() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+// EndpointStats counts what happened to the requests of one endpoint
+type EndpointStats struct {
+	Requests    int       `json:"requests"`
+	Retries     int       `json:"retries"`
+	RateLimited int       `json:"rate_limited"`
+	Errors      int       `json:"errors"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// Client is what the providers and the downloads talk to upstream with. It
+// retries network errors, 5xx and 429 with jittered exponential backoff, and
+// waits as long as Retry-After asks for when it's there. Every request is
+// labelled with an endpoint name to keep per-endpoint counters.
+type Client struct {
+	http    *http.Client
+	retries int
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats map[string]*EndpointStats
+}
+
+func NewClient(timeout time.Duration, retries int) *Client {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return &Client{
+		http: &http.Client{
+			// Covers the whole request, body included
+			Timeout: timeout,
+			Transport: &http.Transport{
+				// HTTPS_PROXY and friends, as http.Get did
+				Proxy: http.ProxyFromEnvironment,
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.DialTimeout(network, addr, 3*time.Second)
+				},
+				TLSHandshakeTimeout: 10 * time.Second,
+				// Shared by all the download workers, so connections get reused
+				MaxIdleConnsPerHost: defaultWorkers,
+			},
+		},
+		retries: retries,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		stats:   make(map[string]*EndpointStats),
+	}
+}
+
+// Get returns the first 2xx response for url, the caller closes its body.
+// URLs are only logged and returned in errors with their secrets redacted,
+// see redactURL.
+// Requests are logged at debug level with the logger of ctx, retries at warn.
+func (c *Client) Get(ctx context.Context, endpoint, url string) (*http.Response, error) {
+	log := logFrom(ctx).With("endpoint", endpoint, "url", redactURL(url))
+	for attempt := 0; ; attempt++ {
+		c.count(endpoint, func(s *EndpointStats) { s.Requests++ })
+
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, c.fail(endpoint, err)
+		}
+		start := time.Now()
+		resp, err := c.http.Do(req.WithContext(ctx))
+		upstreamDuration.ObserveSince(start, endpoint)
+		if err != nil {
+			upstreamRequests.Inc(endpoint, "error")
+		} else {
+			upstreamRequests.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+			log.Debug("GET", "status", resp.StatusCode, "attempt", attempt+1, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+		}
+		if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		var wait time.Duration
+		if err != nil {
+			err = fmt.Errorf("%s: %s", endpoint, redactError(err))
+		} else {
+			resp.Body.Close()
+			statusErr := &StatusError{Endpoint: endpoint, Code: resp.StatusCode}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				c.count(endpoint, func(s *EndpointStats) { s.RateLimited++ })
+				wait = retryAfter(resp.Header.Get("Retry-After"))
+			}
+			if !statusErr.Temporary() {
+				return nil, c.fail(endpoint, statusErr)
+			}
+			err = statusErr
+		}
+
+		// Cancelled, retrying wouldn't go anywhere
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= c.retries {
+			return nil, c.fail(endpoint, err)
+		}
+		if wait == 0 {
+			wait = c.backoff(attempt)
+		}
+		c.count(endpoint, func(s *EndpointStats) { s.Retries++ })
+		log.Warn("retrying", "error", err, "attempt", attempt+1, "wait", wait.String())
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// GetJSON decodes the response of url into dest
+func (c *Client) GetJSON(ctx context.Context, endpoint, url string, dest interface{}) error {
+	resp, err := c.Get(ctx, endpoint, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return c.fail(endpoint, err)
+	}
+	if err := json.Unmarshal(b, dest); err != nil {
+		return c.fail(endpoint, fmt.Errorf("%s: invalid JSON response: %s", endpoint, err))
+	}
+	return nil
+}
+
+// A copy of the counters, keyed by endpoint
+func (c *Client) Stats() map[string]EndpointStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make(map[string]EndpointStats, len(c.stats))
+	for endpoint, s := range c.stats {
+		stats[endpoint] = *s
+	}
+	return stats
+}
+
+func (c *Client) count(endpoint string, fn func(*EndpointStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.stats[endpoint]
+	if !ok {
+		s = &EndpointStats{}
+		c.stats[endpoint] = s
+	}
+	fn(s)
+}
+
+func (c *Client) fail(endpoint string, err error) error {
+	c.count(endpoint, func(s *EndpointStats) {
+		s.Errors++
+		s.LastError = err.Error()
+		s.LastErrorAt = time.Now()
+	})
+	return err
+}
+
+// Full jitter, a random delay between 0 and the exponential backoff
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func (c *Client) backoff(attempt int) time.Duration {
+	max := baseBackoff << uint(attempt)
+	if max > maxBackoff || max <= 0 {
+		max = maxBackoff
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rand.Int63n(int64(max))) + time.Millisecond
+}
+
+// Retry-After is either a number of seconds or an HTTP date, 0 if missing
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	if secs, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		wait = time.Until(t)
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Encoders are reused, making one allocates a lot
+var (
+	gzipPool = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibPool = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// Compresses the responses that are worth it with gzip or deflate, whichever
+// the client prefers. Covers are JPEG or PNG already, so they are sent as
+// they are.
+func compress(c *gin.Context) {
+	w := &compressWriter{
+		ResponseWriter: c.Writer,
+		encoding:       acceptedEncoding(c.Request.Header.Get("Accept-Encoding")),
+		head:           c.Request.Method == http.MethodHead,
+	}
+	c.Writer = w
+	c.Next()
+	w.Close()
+}
+
+// Picks gzip or deflate from an Accept-Encoding, "" when the client takes
+// neither. gzip wins a tie.
+func acceptedEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			name = "gzip"
+		}
+		if (name == "gzip" || name == "deflate") && q > 0 && (q > bestQ || q == bestQ && name == "gzip") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// JSON, text and SVG shrink well, images and archives don't
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasPrefix(mediaType, "text/") || mediaType == "image/svg+xml"
+}
+
+// compressWriter decides whether to compress once the handler starts writing
+// the body, when the status and Content-Type are known
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	head     bool
+
+	decided bool
+	enc     interface {
+		io.WriteCloser
+		Flush() error
+	}
+}
+
+func (w *compressWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	h := w.Header()
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	switch status := w.Status(); {
+	case w.encoding == "", w.head, h.Get("Content-Encoding") != "":
+		return
+	case status < 200, status == http.StatusNoContent, status == http.StatusPartialContent, status == http.StatusNotModified:
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	if w.encoding == "gzip" {
+		gz := gzipPool.Get().(*gzip.Writer)
+		gz.Reset(w.ResponseWriter)
+		w.enc = gz
+	} else {
+		zw := zlibPool.Get().(*zlib.Writer)
+		zw.Reset(w.ResponseWriter)
+		w.enc = zw
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	w.decide()
+	if w.enc == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.enc.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	w.decide()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Writes what the encoder still holds and puts it back in its pool
+func (w *compressWriter) Close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(enc)
+	case *zlib.Writer:
+		zlibPool.Put(enc)
+	}
+	w.enc = nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Read when there is no -config and FOLI_CONFIG isn't set, if it exists
+const defaultConfigFile = "foli.yaml"
+
+// Config is every setting of foli. They are read from the YAML config file,
+// then the env vars named in the env tags override them, then the flags of
+// the command. See foli.example.yaml.
+type Config struct {
+	// Addresses the server listens on, separated by commas, unix:/path for
+	// a Unix socket
+	Listen string `yaml:"listen" env:"LISTEN"`
+	// Permissions of the Unix sockets, in octal
+	SocketMode string `yaml:"socket_mode" env:"SOCKET_MODE"`
+	// How long serve waits for requests and the crawl to finish once asked
+	// to stop
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	DB              string        `yaml:"db" env:"DB"`
+	// Behance API key, unless Fixture points to a fixture file. APIFile is
+	// a file holding it instead, e.g. a mounted secret.
+	API     string `yaml:"api" env:"API"`
+	APIFile string `yaml:"api_file" env:"API_FILE"`
+	Fixture string `yaml:"fixture" env:"FIXTURE"`
+
+	Crawl  CrawlConfig  `yaml:"crawl"`
+	HTTP   HTTPConfig   `yaml:"http"`
+	Images ImagesConfig `yaml:"images"`
+	S3     S3Config     `yaml:"s3"`
+	Thumbs ThumbsConfig `yaml:"thumbs"`
+	Cache  CacheConfig  `yaml:"cache"`
+	Log    LogConfig    `yaml:"log"`
+	Auth   AuthConfig   `yaml:"auth"`
+	Limits LimitsConfig `yaml:"limits"`
+	TLS    TLSConfig    `yaml:"tls"`
+
+	// The file it was loaded from, read again on SIGHUP
+	path string
+}
+
+type CrawlConfig struct {
+	// Pages of creators walked through by a crawl
+	Pages   int `yaml:"pages" env:"CRAWL_PAGES"`
+	Workers int `yaml:"workers" env:"WORKERS"`
+	// How often serve crawls in the background, 0 to never do it
+	Interval time.Duration `yaml:"interval" env:"SYNC_INTERVAL"`
+	// Whether /readyz waits for the first background crawl to be over
+	ReadyAfterFirst bool `yaml:"ready_after_first" env:"READY_AFTER_FIRST_CRAWL"`
+}
+
+type HTTPConfig struct {
+	Timeout time.Duration `yaml:"timeout" env:"HTTP_TIMEOUT"`
+	Retries int           `yaml:"retries" env:"HTTP_RETRIES"`
+}
+
+type ImagesConfig struct {
+	// Where the local store keeps covers
+	Dir string `yaml:"dir" env:"IMAGE_DIR"`
+	// local or s3
+	Store string `yaml:"store" env:"BLOB_STORE"`
+	// stream or redirect, see serveImage
+	Serve  string        `yaml:"serve" env:"IMG_SERVE"`
+	URLTTL time.Duration `yaml:"url_ttl" env:"IMG_URL_TTL"`
+	// Covers bigger than this aren't downloaded
+	MaxSizeMB int `yaml:"max_size_mb" env:"IMG_MAX_SIZE"`
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET"`
+	Region    string `yaml:"region" env:"S3_REGION"`
+	AccessKey string `yaml:"access_key" env:"S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"S3_SECRET_KEY"`
+	// Files holding the keys instead
+	AccessKeyFile string `yaml:"access_key_file" env:"S3_ACCESS_KEY_FILE"`
+	SecretKeyFile string `yaml:"secret_key_file" env:"S3_SECRET_KEY_FILE"`
+}
+
+type ThumbsConfig struct {
+	Dir    string `yaml:"dir" env:"THUMB_CACHE_DIR"`
+	SizeMB int    `yaml:"size_mb" env:"THUMB_CACHE_SIZE"`
+}
+
+type CacheConfig struct {
+	// MB of responses kept in memory until the entries change, 0 to not
+	// cache them
+	SizeMB int `yaml:"size_mb" env:"HTTP_CACHE_SIZE"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error, PUT /log/level changes it at runtime
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// json, or text for people
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type AuthConfig struct {
+	// Whether requests need an API key, see foli keys. On unless turned off,
+	// without it anyone can change the entries and download foli.db.
+	Enabled bool `yaml:"enabled" env:"AUTH_ENABLED"`
+}
+
+type LimitsConfig struct {
+	// Requests per second a client (its IP, and its API key) may make, 0 for
+	// no limit. Burst is how many it may make at once.
+	Rate  float64 `yaml:"rate" env:"RATE_LIMIT"`
+	Burst int     `yaml:"burst" env:"RATE_BURST"`
+	// Proxies whose X-Forwarded-For tells the IP of the client, IPs or CIDRs
+	// separated by commas, and unix for the connections to Unix sockets
+	TrustedProxies string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// Queries in one POST /q, and matches returned by each of them
+	MaxQueries int `yaml:"max_queries" env:"MAX_QUERIES"`
+	MaxResults int `yaml:"max_results" env:"MAX_RESULTS"`
+}
+
+type TLSConfig struct {
+	// PEM files of the certificate, with its chain, and of its key. Serving
+	// TLS needs both, they're loaded again when they change.
+	Cert string `yaml:"cert" env:"TLS_CERT"`
+	Key  string `yaml:"key" env:"TLS_KEY"`
+	// PEM file of the CAs of client certificates, clients need one when set
+	ClientCA string `yaml:"client_ca" env:"TLS_CLIENT_CA"`
+	// How often the files are checked for changes, 0 to only check on SIGHUP
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	// Whether clients may use HTTP/2
+	HTTP2 bool `yaml:"http2" env:"HTTP2"`
+}
+
+// Whether the server is to serve TLS
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != "" || t.Key != ""
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:          ":8080",
+		SocketMode:      defaultSocketMode,
+		ShutdownTimeout: defaultShutdownTimeout,
+		DB:              filepath.Join(".", "foli.db"),
+		Crawl: CrawlConfig{
+			Pages:    defaultCrawlPages,
+			Workers:  defaultWorkers,
+			Interval: defaultSyncInterval,
+		},
+		HTTP: HTTPConfig{
+			Timeout: defaultHTTPTimeout,
+			Retries: defaultHTTPRetries,
+		},
+		Images: ImagesConfig{
+			Dir:       filepath.Join(".", "images"),
+			Store:     "local",
+			Serve:     serveStream,
+			URLTTL:    defaultImageURLTTL,
+			MaxSizeMB: defaultMaxImageMB,
+		},
+		S3:     S3Config{Region: "us-east-1"},
+		Thumbs: ThumbsConfig{Dir: defaultThumbCacheDir, SizeMB: defaultThumbCacheMB},
+		Log:    LogConfig{Level: "info", Format: "json"},
+		Auth:   AuthConfig{Enabled: true},
+		Limits: LimitsConfig{
+			Rate:       defaultRateLimit,
+			Burst:      defaultRateBurst,
+			MaxQueries: defaultMaxQueries,
+			MaxResults: defaultMaxResults,
+		},
+		TLS: TLSConfig{ReloadInterval: defaultTLSReloadInterval, HTTP2: true},
+	}
+}
+
+// Loads the config file at path, or the default one if path is "" and it
+// exists, then applies the env overrides. Keys the file shouldn't have are
+// errors, so typos don't go unnoticed.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("FOLI_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	cfg.path = path
+
+	// gin used to listen on $PORT
+	if port, ok := os.LookupEnv("PORT"); ok {
+		cfg.Listen = ":" + port
+	}
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	if err := cfg.loadSecrets(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Reads the secrets given as files, and registers all of them so they are
+// masked in the logs
+func (cfg *Config) loadSecrets() error {
+	for _, s := range []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"api", &cfg.API, cfg.APIFile},
+		{"s3.access_key", &cfg.S3.AccessKey, cfg.S3.AccessKeyFile},
+		{"s3.secret_key", &cfg.S3.SecretKey, cfg.S3.SecretKeyFile},
+	} {
+		if s.file != "" {
+			if *s.value != "" {
+				return fmt.Errorf("both %s and %s_file are set, use one of them", s.name, s.name)
+			}
+			secret, err := readSecretFile(s.file)
+			if err != nil {
+				return fmt.Errorf("%s_file: %s", s.name, err)
+			}
+			*s.value = secret
+		}
+		registerSecret(*s.value)
+	}
+	return nil
+}
+
+// Sets the fields which have an env tag from the env, going through nested
+// structs
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+		key := field.Tag.Get("env")
+		raw, ok := os.LookupEnv(key)
+		if key == "" || !ok {
+			continue
+		}
+
+		switch {
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("%s should be a duration like \"1h\", got \"%s\"", key, raw)
+			}
+			value.SetInt(int64(d))
+		case field.Type.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("%s should be true or false, got \"%s\"", key, raw)
+			}
+			value.SetBool(b)
+		case field.Type.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return fmt.Errorf("%s should be a number, got \"%s\"", key, raw)
+			}
+			value.SetFloat(f)
+		case field.Type.Kind() == reflect.Int:
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				return fmt.Errorf("%s should be a number, got \"%s\"", key, raw)
+			}
+			value.SetInt(int64(n))
+		case field.Type.Kind() == reflect.String:
+			value.SetString(raw)
+		}
+	}
+	return nil
+}
+
+// Checks every setting, the error lists all that are wrong. needsProvider
+// is for the commands that crawl.
+func (cfg *Config) validate(needsProvider bool) error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	addrs := listenAddrs(cfg.Listen)
+	check(len(addrs) > 0, "listen can't be empty")
+	for _, addr := range addrs {
+		if err := checkListenAddr(addr); err != nil {
+			check(false, "listen: %s", err)
+		}
+	}
+	if _, err := parseSocketMode(cfg.SocketMode); err != nil {
+		check(false, "socket_mode: %s", err)
+	}
+	check(cfg.ShutdownTimeout > 0, "shutdown_timeout should be more than 0")
+	check(cfg.DB != "", "db can't be empty")
+	if needsProvider {
+		check(cfg.API != "" || cfg.Fixture != "",
+			"api (or API) should be the Behance api key or client id in order to query images, or fixture a fixture file")
+	}
+
+	check(cfg.Crawl.Pages >= 1, "crawl.pages should be at least 1, got %d", cfg.Crawl.Pages)
+	check(cfg.Crawl.Workers >= 1, "crawl.workers should be at least 1, got %d", cfg.Crawl.Workers)
+	check(cfg.Crawl.Interval >= 0, "crawl.interval can't be negative")
+	check(cfg.HTTP.Timeout > 0, "http.timeout should be more than 0")
+	check(cfg.HTTP.Retries >= 0, "http.retries can't be negative")
+	check(cfg.Cache.SizeMB >= 0, "cache.size_mb can't be negative")
+
+	check(cfg.Images.Dir != "", "images.dir can't be empty")
+	check(cfg.Images.Serve == serveStream || cfg.Images.Serve == serveRedirect,
+		"images.serve should be %s or %s, got \"%s\"", serveStream, serveRedirect, cfg.Images.Serve)
+	check(cfg.Images.URLTTL > 0, "images.url_ttl should be more than 0")
+	check(cfg.Images.MaxSizeMB >= 1, "images.max_size_mb should be at least 1, got %d", cfg.Images.MaxSizeMB)
+	switch cfg.Images.Store {
+	case "local":
+	case "s3":
+		check(cfg.S3.Endpoint != "", "s3.endpoint is needed with images.store s3")
+		check(cfg.S3.Bucket != "", "s3.bucket is needed with images.store s3")
+		check(cfg.S3.AccessKey != "", "s3.access_key is needed with images.store s3")
+		check(cfg.S3.SecretKey != "", "s3.secret_key is needed with images.store s3")
+	default:
+		check(false, "images.store should be local or s3, got \"%s\"", cfg.Images.Store)
+	}
+
+	check(cfg.Thumbs.Dir != "", "thumbs.dir can't be empty")
+	check(cfg.Thumbs.SizeMB >= 1, "thumbs.size_mb should be at least 1, got %d", cfg.Thumbs.SizeMB)
+
+	check(cfg.Limits.Rate >= 0, "limits.rate can't be negative")
+	check(cfg.Limits.Rate == 0 || cfg.Limits.Burst >= 1, "limits.burst should be at least 1, got %d", cfg.Limits.Burst)
+	check(cfg.Limits.MaxQueries >= 1, "limits.max_queries should be at least 1, got %d", cfg.Limits.MaxQueries)
+	check(cfg.Limits.MaxResults >= 1, "limits.max_results should be at least 1, got %d", cfg.Limits.MaxResults)
+	if _, err := parseTrustedProxies(cfg.Limits.TrustedProxies); err != nil {
+		check(false, "limits.trusted_proxies: %s", err)
+	}
+
+	if cfg.TLS.Enabled() {
+		check(cfg.TLS.Cert != "" && cfg.TLS.Key != "", "tls.cert and tls.key go together, set both")
+	}
+	check(cfg.TLS.ClientCA == "" || cfg.TLS.Enabled(), "tls.client_ca needs tls.cert and tls.key")
+	check(cfg.TLS.ReloadInterval >= 0, "tls.reload_interval can't be negative")
+
+	_, err := parseLevel(cfg.Log.Level)
+	check(err == nil, "log.level should be debug, info, warn or error, got \"%s\"", cfg.Log.Level)
+	check(cfg.Log.Format == "json" || cfg.Log.Format == "text", "log.format should be json or text, got \"%s\"", cfg.Log.Format)
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+}
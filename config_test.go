@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "foli.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+listen: ":9000"
+crawl:
+  workers: 8
+  interval: 2h
+images:
+  store: s3
+limits:
+  rate: 2.5
+`)
+	t.Setenv("WORKERS", "3")
+	t.Setenv("AUTH_ENABLED", "false")
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9000" || cfg.Crawl.Interval != 2*time.Hour || cfg.Images.Store != "s3" || cfg.Limits.Rate != 2.5 {
+		t.Errorf("the file isn't applied: %+v", cfg)
+	}
+	// The env wins over the file, which wins over the defaults
+	if cfg.Crawl.Workers != 3 || cfg.Auth.Enabled {
+		t.Errorf("workers %d, auth %v, want what the env says", cfg.Crawl.Workers, cfg.Auth.Enabled)
+	}
+	if cfg.Crawl.Pages != defaultCrawlPages || cfg.Images.MaxSizeMB != defaultMaxImageMB {
+		t.Errorf("pages %d, max size %d, want the defaults", cfg.Crawl.Pages, cfg.Images.MaxSizeMB)
+	}
+
+	t.Setenv("PORT", "3000")
+	if cfg, err := loadConfig(path); err != nil || cfg.Listen != ":3000" {
+		t.Errorf("listen = %q, %v, want PORT to win", cfg.Listen, err)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		yaml, env, value, err string
+	}{
+		{"crawl:\n  worker: 8\n", "", "", "field worker not found"},
+		{"", "SYNC_INTERVAL", "soon", "SYNC_INTERVAL should be a duration"},
+		{"", "WORKERS", "many", "WORKERS should be a number"},
+		{"", "AUTH_ENABLED", "maybe", "AUTH_ENABLED should be true or false"},
+		{"api: key\napi_file: /run/secrets/key\n", "", "", "both api and api_file are set"},
+		{"api_file: /nonexistent/key\n", "", "", "api_file"},
+	} {
+		// A subtest each, so the env is back as it was after it
+		t.Run(tt.err, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(tt.env, tt.value)
+			}
+			_, err := loadConfig(writeConfig(t, tt.yaml))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q %s=%s: err = %v, want %q", tt.yaml, tt.env, tt.value, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.validate(false); err != nil {
+		t.Fatalf("the defaults aren't valid: %v", err)
+	}
+	if err := cfg.validate(true); err == nil || !strings.Contains(err.Error(), "api (or API)") {
+		t.Errorf("crawling without a provider: err = %v", err)
+	}
+	cfg.Fixture = "fixture.json"
+	if err := cfg.validate(true); err != nil {
+		t.Errorf("crawling a fixture: %v", err)
+	}
+
+	for _, tt := range []struct {
+		change func(*Config)
+		err    string
+	}{
+		{func(c *Config) { c.Listen = " , " }, "listen can't be empty"},
+		{func(c *Config) { c.SocketMode = "rw" }, "socket_mode"},
+		{func(c *Config) { c.Crawl.Workers = 0 }, "crawl.workers should be at least 1, got 0"},
+		{func(c *Config) { c.HTTP.Timeout = 0 }, "http.timeout should be more than 0"},
+		{func(c *Config) { c.Images.Store = "s4" }, `images.store should be local or s3, got "s4"`},
+		{func(c *Config) { c.Images.Store = "s3" }, "s3.endpoint is needed with images.store s3"},
+		{func(c *Config) { c.Images.Serve = "push" }, "images.serve should be"},
+		{func(c *Config) { c.Images.MaxSizeMB = 0 }, "images.max_size_mb should be at least 1"},
+		{func(c *Config) { c.Thumbs.SizeMB = 0 }, "thumbs.size_mb should be at least 1"},
+		{func(c *Config) { c.Limits.Burst = 0 }, "limits.burst should be at least 1"},
+		{func(c *Config) { c.Limits.TrustedProxies = "localhost" }, "limits.trusted_proxies"},
+		{func(c *Config) { c.TLS.Cert = "cert.pem" }, "tls.cert and tls.key go together"},
+		{func(c *Config) { c.TLS.ClientCA = "ca.pem" }, "tls.client_ca needs tls.cert and tls.key"},
+		{func(c *Config) { c.Log.Level = "loud" }, "log.level should be"},
+		{func(c *Config) { c.Log.Format = "xml" }, "log.format should be json or text"},
+	} {
+		cfg := defaultConfig()
+		tt.change(cfg)
+		if err := cfg.validate(false); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("err = %v, want %q", err, tt.err)
+		}
+	}
+
+	// Every problem is reported at once
+	cfg = defaultConfig()
+	cfg.Crawl.Workers, cfg.Images.Store = 0, "s4"
+	err := cfg.validate(false)
+	if err == nil || strings.Count(err.Error(), "\n  ") != 2 {
+		t.Errorf("err = %v, want both problems", err)
+	}
+
+	// A limit of 0 needs no burst
+	cfg = defaultConfig()
+	cfg.Limits.Rate, cfg.Limits.Burst = 0, 0
+	if err := cfg.validate(false); err != nil {
+		t.Errorf("no rate limit: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// Columns of a CSV export, by JSON name. Lists and objects are written as
+// JSON in their cell.
+var csvColumns = []string{
+	"id", "title", "description", "filename", "src", "provider", "upstream_id", "upstream_key",
+	"created_at", "updated_at", "hash", "size", "mime", "curated",
+	"owners", "tags", "fields", "published_at", "modified_at", "views", "appreciations", "comments", "covers",
+}
+
+// Columns holding JSON strings, the others hold JSON in CSV
+var csvTextColumns = map[string]bool{
+	"title": true, "description": true, "filename": true, "src": true, "provider": true,
+	"upstream_id": true, "upstream_key": true, "created_at": true, "updated_at": true,
+	"hash": true, "mime": true, "published_at": true, "modified_at": true,
+}
+
+// Writes every entry to w, one JSON object per line for jsonl or one row per
+// entry under a header row for csv
+func exportData(w io.Writer, db storm.Node, format string) (int, error) {
+	var write func(*Data) error
+	var cw *csv.Writer
+
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		write = func(data *Data) error { return enc.Encode(data) }
+	case "csv":
+		cw = csv.NewWriter(w)
+		if err := cw.Write(csvColumns); err != nil {
+			return 0, err
+		}
+		write = func(data *Data) error {
+			record, err := csvRecord(data)
+			if err != nil {
+				return err
+			}
+			return cw.Write(record)
+		}
+	default:
+		return 0, fmt.Errorf("format should be jsonl or csv, got %s", format)
+	}
+
+	n := 0
+	err := db.Select().Each(new(Data), func(record interface{}) error {
+		n++
+		return write(record.(*Data))
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return n, err
+	}
+	if cw != nil {
+		cw.Flush()
+		return n, cw.Error()
+	}
+	return n, nil
+}
+
+func csvRecord(data *Data) ([]string, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+
+	record := make([]string, len(csvColumns))
+	for i, column := range csvColumns {
+		raw := fields[column]
+		switch {
+		case raw == nil || string(raw) == "null":
+		case csvTextColumns[column]:
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, err
+			}
+			record[i] = s
+		default:
+			record[i] = string(raw)
+		}
+	}
+	return record, nil
+}
+
+// Reads back what exportData wrote, calling add for every entry
+func importData(r io.Reader, format string, add func(*Data) error) (int, error) {
+	n := 0
+	switch format {
+	case "jsonl":
+		lines := bufio.NewScanner(r)
+		lines.Buffer(make([]byte, 64*1024), 16<<20)
+		for lines.Scan() {
+			if strings.TrimSpace(lines.Text()) == "" {
+				continue
+			}
+			var data Data
+			if err := json.Unmarshal(lines.Bytes(), &data); err != nil {
+				return n, fmt.Errorf("line %d: %s", n+1, err)
+			}
+			if err := add(&data); err != nil {
+				return n, err
+			}
+			n++
+		}
+		return n, lines.Err()
+	case "csv":
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return 0, err
+		}
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			data, err := fromCSVRecord(header, record)
+			if err != nil {
+				return n, fmt.Errorf("row %d: %s", n+2, err)
+			}
+			if err := add(data); err != nil {
+				return n, err
+			}
+			n++
+		}
+	default:
+		return 0, fmt.Errorf("format should be jsonl or csv, got %s", format)
+	}
+}
+
+// Builds the JSON of the row back and decodes it, so CSV takes the same
+// values as JSON Lines. Columns it doesn't know are ignored.
+func fromCSVRecord(header, record []string) (*Data, error) {
+	fields := make(map[string]json.RawMessage)
+	for i, column := range header {
+		if i >= len(record) || record[i] == "" {
+			continue
+		}
+		if csvTextColumns[column] {
+			b, _ := json.Marshal(record[i])
+			fields[column] = b
+		} else {
+			fields[column] = json.RawMessage(record[i])
+		}
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var data Data
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// Saves an imported entry. Entries of an upstream project replace the row of
+// that project if there is one, others replace the row with the same title
+// and cover, so importing a file twice doesn't add its entries twice. The
+// rest are added as new rows with a new ID. Covers missing from the store,
+// or whose hash isn't one, are downloaded from their src.
+func importEntry(db *storm.DB, client *Client, store BlobStore, data *Data) error {
+	missing := false
+	if data.Hash != "" && !validHash(data.Hash) {
+		logger.Warn("Not a cover hash, downloading the cover again", "hash", data.Hash, "src", redactURL(data.Src))
+		data.Hash, data.Size, data.MIME = "", 0, ""
+		missing = true
+	} else if data.Hash != "" {
+		if err := claimCover(db, data.Hash); err != nil {
+			return err
+		}
+		exists, err := store.Exists(blobKey(data.Hash))
+		if err != nil {
+			return err
+		}
+		missing = !exists
+	}
+	if missing && data.Src != "" {
+		info, err := fetchImages(context.Background(), db, client, store, data.Src)
+		if err != nil {
+			logger.Warn("Can't download the cover", "src", redactURL(data.Src), "error", err)
+		} else {
+			data.Hash, data.Size, data.MIME = info.Hash, info.Size, info.MIME
+		}
+	}
+
+	return db.Bolt.Update(func(btx *bolt.Tx) error {
+		tx := db.WithTransaction(btx)
+		existing, err := importedEntry(tx, data)
+		switch err {
+		case nil:
+			data.ID = existing.ID
+		case storm.ErrNotFound:
+			// A given ID would be overwritten by the next one storm hands out
+			data.ID = 0
+		default:
+			return err
+		}
+		if err := tx.Save(data); err != nil {
+			return err
+		}
+		if err := keepCover(tx, data.Hash); err != nil {
+			return err
+		}
+		if existing.Hash != data.Hash {
+			if err := releaseCover(tx, existing.Hash); err != nil {
+				return err
+			}
+		}
+		if err := bumpChanges(tx); err != nil {
+			return err
+		}
+		return indexDocument(btx, data)
+	})
+}
+
+// The row an imported entry replaces: the one of its upstream project, or
+// for entries without one, a row without one either with the same title and
+// cover (or src, before it's downloaded)
+func importedEntry(tx storm.Node, data *Data) (Data, error) {
+	var existing Data
+	if data.UpstreamKey != "" {
+		err := tx.One("UpstreamKey", data.UpstreamKey, &existing)
+		return existing, err
+	}
+
+	field, value := "Hash", data.Hash
+	if value == "" {
+		field, value = "Src", data.Src
+	}
+	if value == "" {
+		return existing, storm.ErrNotFound
+	}
+	var same []Data
+	if err := tx.Find(field, value, &same); err != nil {
+		return existing, err
+	}
+	for _, row := range same {
+		if row.UpstreamKey == "" && row.Title == data.Title && (field == "Hash" || row.Hash == "") {
+			return row, nil
+		}
+	}
+	return existing, storm.ErrNotFound
+}
+
+// foli export [-format jsonl|csv] [-o file]
+func exportCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	out := flags.String("o", "-", "file to write, - for stdout")
+	flags.Parse(args)
+
+	db := openDB(cfg)
+	defer db.Close()
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := exportData(w, db, *format)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d entries\n", n)
+}
+
+// foli import [-format jsonl|csv] file
+func importCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "jsonl or csv, by default from the file extension")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: foli import [-format jsonl|csv] file, - for stdin")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = "jsonl"
+		if strings.HasSuffix(path, ".csv") {
+			*format = "csv"
+		}
+	}
+
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := openDB(cfg)
+	defer db.Close()
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	client := NewClient(cfg.HTTP.Timeout, cfg.HTTP.Retries)
+	store := newBlobStore(cfg)
+
+	n, err := importData(r, *format, func(data *Data) error {
+		return importEntry(db, client, store, data)
+	})
+	if err != nil {
+		log.Fatalf("After %d entries: %s\n", n, err)
+	}
+	fmt.Printf("Imported %d entries\n", n)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	images := newImageServer(t, nil)
+	src := newTestDB(t)
+	client := NewClient(5*time.Second, 0)
+	store := NewLocalStore(t.TempDir())
+
+	crawled := Data{Title: "Crawled", Provider: "test", UpstreamID: "1", Src: images.URL + "/1.png"}
+	crawled.Tags = []string{"print", "poster"}
+	crawled.Covers = map[string]string{"original": crawled.Src}
+	manual := Data{Title: "Manual, \"quoted\"", Provider: manualProvider, Curated: true, Src: images.URL + "/2.png"}
+	for _, data := range []*Data{&crawled, &manual} {
+		info, err := fetchImages(context.Background(), src, client, store, data.Src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Hash, data.Size, data.MIME = info.Hash, info.Size, info.MIME
+		if err := upsert(src, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range []string{"jsonl", "csv"} {
+		var buf bytes.Buffer
+		if n, err := exportData(&buf, src, format); err != nil || n != 2 {
+			t.Fatalf("%s: exported %d, %v", format, n, err)
+		}
+
+		dst := newTestDB(t)
+		// Twice, the second import replaces what the first added
+		for i := 0; i < 2; i++ {
+			_, err := importData(bytes.NewReader(buf.Bytes()), format, func(data *Data) error {
+				return importEntry(dst, client, store, data)
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		var rows []Data
+		if err := dst.All(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2 {
+			t.Fatalf("%s: %d rows after importing twice, want 2", format, len(rows))
+		}
+		got, want := rows[0], crawled
+		if got.Title != want.Title || got.UpstreamKey != want.UpstreamKey || got.Hash != want.Hash ||
+			strings.Join(got.Tags, ",") != "print,poster" || got.Covers["original"] != want.Src {
+			t.Errorf("%s: imported %+v, want %+v", format, got, want)
+		}
+		if got := rows[1]; got.Title != manual.Title || got.Hash != manual.Hash || !got.Curated {
+			t.Errorf("%s: imported %+v, want %+v", format, got, manual)
+		}
+	}
+}
+
+func TestImportChecksHashes(t *testing.T) {
+	images := newImageServer(t, nil)
+	db := newTestDB(t)
+	client := NewClient(5*time.Second, 0)
+	store := NewLocalStore(t.TempDir())
+
+	for _, hash := range []string{"a", "../../../etc/passwd", strings.Repeat("A", 64)} {
+		data := Data{Title: "Bad " + hash, Src: images.URL + "/" + hash[:1] + ".png", Hash: hash}
+		if err := importEntry(db, client, store, &data); err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		if !validHash(data.Hash) || !blobExists(t, store, data.Hash) {
+			t.Errorf("%s: saved with the hash %q, want the cover downloaded again", hash, data.Hash)
+		}
+	}
+
+	// Nothing to download it from, the hash is dropped
+	data := Data{Title: "No src", Hash: "a"}
+	if err := importEntry(db, client, store, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Hash != "" {
+		t.Errorf("saved with the hash %q, want none", data.Hash)
+	}
+}
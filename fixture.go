@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// How many creators the fixture hands out per page, same as Behance does.
+const fixturePageSize = 10
+
+// Fixture is a Provider backed by a local JSON file, handy for trying foli
+// out without a Behance API key. The file looks like
+//
+//	{
+//	    "creators": [
+//	        {"id": "1", "username": "someone", "projects": [
+//	            {"id": "42", "title": "...", "description": "...", "src": "http://...",
+//	             "tags": ["..."], "views": 10, ...}
+//	        ]}
+//	    ]
+//	}
+//
+// Projects can have any field of Metadata.
+type Fixture struct {
+	creators []fixtureCreator
+	projects map[string]Cover
+}
+
+type fixtureCreator struct {
+	Creator
+	Projects []Cover `json:"projects"`
+}
+
+func NewFixture(path string) (*Fixture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Creators []fixtureCreator `json:"creators"`
+	}
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("fixture %s: %s", path, err)
+	}
+
+	fixture := &Fixture{creators: file.Creators, projects: make(map[string]Cover)}
+	for _, creator := range file.Creators {
+		for _, project := range creator.Projects {
+			fixture.projects[project.ProjectID] = project
+		}
+	}
+	return fixture, nil
+}
+
+func (f *Fixture) Name() string { return "fixture" }
+
+func (f *Fixture) ListCreators(ctx context.Context, page int) ([]Creator, error) {
+	start := (page - 1) * fixturePageSize
+	if start < 0 || start >= len(f.creators) {
+		return nil, nil
+	}
+	end := start + fixturePageSize
+	if end > len(f.creators) {
+		end = len(f.creators)
+	}
+
+	creators := make([]Creator, 0, end-start)
+	for _, creator := range f.creators[start:end] {
+		creators = append(creators, creator.Creator)
+	}
+	return creators, nil
+}
+
+func (f *Fixture) ListProjects(ctx context.Context, creator Creator) ([]string, error) {
+	for _, c := range f.creators {
+		if c.ID != creator.ID {
+			continue
+		}
+		ids := make([]string, len(c.Projects))
+		for i, project := range c.Projects {
+			ids[i] = project.ProjectID
+		}
+		return ids, nil
+	}
+	return nil, fmt.Errorf("fixture: unknown creator %s", creator.ID)
+}
+
+func (f *Fixture) ResolveCover(ctx context.Context, projectID string) (Cover, error) {
+	cover, ok := f.projects[projectID]
+	if !ok {
+		return Cover{}, fmt.Errorf("fixture: unknown project %s", projectID)
+	}
+	return cover, nil
+}
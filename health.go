@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/gin-gonic/gin"
+)
+
+// Check is the outcome of one dependency check of /readyz
+type Check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Runs check, giving up on it after readyCheckTimeout, e.g. when S3 hangs
+func runCheck(check func() error) Check {
+	done := make(chan error, 1)
+	go func() { done <- check() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(readyCheckTimeout):
+		err = fmt.Errorf("timed out after %s", readyCheckTimeout)
+	}
+	if err != nil {
+		return Check{Error: err.Error()}
+	}
+	return Check{OK: true}
+}
+
+// Readiness is what /readyz responds with
+type Readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks map[string]Check `json:"checks"`
+	Sync   SyncState        `json:"sync"`
+}
+
+// SyncState is the state of the background crawl as seen by /readyz
+type SyncState struct {
+	Crawling bool     `json:"crawling"`
+	Running  bool     `json:"running"`
+	LastRun  *SyncRun `json:"last_run"`
+	// False until the first crawl is over, when crawl.ready_after_first
+	// makes readiness wait for it
+	Loaded bool `json:"loaded"`
+}
+
+// GET /healthz, foli is up and serving requests. It doesn't look at the
+// dependencies, restarting wouldn't fix them.
+func (e *Env) healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GET /readyz, 200 when foli.db can be read, the image store could be
+// written to in the last 30s and, if crawl.ready_after_first is set, the
+// first crawl is over. 503 otherwise, the body tells which check failed.
+func (e *Env) readyz(c *gin.Context) {
+	r := Readiness{Checks: map[string]Check{
+		"db":     runCheck(e.checkDB),
+		"images": runCheck(e.checkStore),
+	}}
+
+	lastRun := e.scheduler.LastRun()
+	r.Sync = SyncState{
+		Crawling: e.crawling,
+		Running:  e.scheduler.Running(),
+		LastRun:  lastRun,
+		Loaded:   !e.crawling || lastRun != nil,
+	}
+
+	r.Ready = true
+	for name, check := range r.Checks {
+		if !check.OK {
+			requestLog(c).Warn("Not ready", "check", name, "error", check.Error)
+			r.Ready = false
+		}
+	}
+	if e.settings().readyAfterFirstCrawl && !r.Sync.Loaded {
+		r.Ready = false
+	}
+
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, r)
+}
+
+// Opens a read transaction and reads the schema version
+func (e *Env) checkDB() error {
+	return e.db.Bolt.View(func(tx *bolt.Tx) error {
+		_, err := schemaVersion(e.db.WithTransaction(tx))
+		return err
+	})
+}
+
+// Writes a small blob and deletes it again, under a key of its own so
+// concurrent checks don't trip over each other. The outcome is reused for
+// storeCheckTTL, on S3 every check is two paid requests. The probe runs
+// without the lock, checks coming in meanwhile get the last outcome instead
+// of waiting for a slow store.
+func (e *Env) checkStore() error {
+	check := &e.storeCheck
+	check.mu.Lock()
+	if check.inflight || time.Since(check.at) < storeCheckTTL {
+		err := check.err
+		if check.at.IsZero() {
+			err = errors.New("the first check is still running")
+		}
+		check.mu.Unlock()
+		return err
+	}
+	check.inflight = true
+	check.mu.Unlock()
+
+	err := e.writeProbe()
+
+	check.mu.Lock()
+	check.at, check.err, check.inflight = time.Now(), err, false
+	check.mu.Unlock()
+	return err
+}
+
+func (e *Env) writeProbe() error {
+	key := "health-" + newID()
+	if err := e.store.Put(key, strings.NewReader("ok"), 2, "text/plain"); err != nil {
+		return err
+	}
+	return e.store.Delete(key)
+}
+
+// How long a check may take before readiness reports it failed
+const readyCheckTimeout = 5 * time.Second
+
+// How long the outcome of checkStore is reused
+const storeCheckTTL = 30 * time.Second
+
+// The last outcome of a check, see checkStore
+type cachedCheck struct {
+	mu  sync.Mutex
+	at  time.Time
+	err error
+	// A check is running
+	inflight bool
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// Counts the blobs put into a LocalStore
+type countingStore struct {
+	*LocalStore
+	puts int
+}
+
+func (s *countingStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	s.puts++
+	return s.LocalStore.Put(key, r, size, contentType)
+}
+
+func TestCheckStoreIsCached(t *testing.T) {
+	store := &countingStore{LocalStore: NewLocalStore(t.TempDir())}
+	e := &Env{store: store}
+
+	for i := 0; i < 3; i++ {
+		if err := e.checkStore(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.puts != 1 {
+		t.Errorf("3 checks wrote %d probes, want 1", store.puts)
+	}
+
+	e.storeCheck.at = time.Now().Add(-storeCheckTTL)
+	if err := e.checkStore(); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != 2 {
+		t.Errorf("a check after the TTL wrote %d probes in all, want 2", store.puts)
+	}
+}
+
+// Blocks every Put until release is closed
+type slowStore struct {
+	*LocalStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	s.started <- struct{}{}
+	<-s.release
+	return s.LocalStore.Put(key, r, size, contentType)
+}
+
+func TestCheckStoreDoesntWaitForAProbe(t *testing.T) {
+	store := &slowStore{LocalStore: NewLocalStore(t.TempDir()), started: make(chan struct{}, 1), release: make(chan struct{})}
+	e := &Env{store: store}
+
+	done := make(chan error)
+	go func() { done <- e.checkStore() }()
+	<-store.started
+	// No outcome yet
+	if err := e.checkStore(); err == nil {
+		t.Error("a check during the first probe passed")
+	}
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A probe is due, but the one running answers for it
+	e.storeCheck.at = time.Now().Add(-storeCheckTTL)
+	store.release = make(chan struct{})
+	go func() { done <- e.checkStore() }()
+	<-store.started
+	if err := e.checkStore(); err != nil {
+		t.Errorf("a check during a probe = %v, want the last outcome", err)
+	}
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
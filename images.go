@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/gin-gonic/gin"
+)
+
+// Where the images of the local store live, and where older versions stored
+// them by the last segment of their URL.
+var imageDir = filepath.Join(".", "images")
+
+// How /imgs hands out covers, see serveImage
+const (
+	serveStream   = "stream"
+	serveRedirect = "redirect"
+)
+
+// How long a redirect to a presigned URL stays valid, unless images.url_ttl
+// says otherwise
+const defaultImageURLTTL = 15 * time.Minute
+
+// Covers bigger than this aren't downloaded, see images.max_size_mb
+const defaultMaxImageMB = 20
+
+var maxImageSize int64 = defaultMaxImageMB << 20
+
+// ImageInfo describes a downloaded cover
+type ImageInfo struct {
+	Hash string
+	Size int64
+	MIME string
+}
+
+// Downloads src into the blob store. The body goes to a temporary file while
+// it is hashed, and is only stored under its content address once it is
+// complete, so a broken download never shows up as an image. The same cover
+// downloaded twice is stored once. Anything bigger than maxImageSize or
+// that doesn't look like an image is refused.
+func fetchImages(ctx context.Context, db *storm.DB, client *Client, store BlobStore, src string) (ImageInfo, error) {
+	info, err := downloadImage(ctx, db, client, store, src)
+	if err != nil {
+		downloadErrors.Inc()
+	}
+	return info, err
+}
+
+func downloadImage(ctx context.Context, db *storm.DB, client *Client, store BlobStore, src string) (ImageInfo, error) {
+	resp, err := client.Get(ctx, "images", src)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > maxImageSize {
+		return ImageInfo{}, fmt.Errorf("image of %d bytes, more than the %d allowed", resp.ContentLength, maxImageSize)
+	}
+
+	tmp, err := ioutil.TempFile("", "foli-download-")
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	sniff := &sniffWriter{}
+	// One byte more than allowed tells a body that's too big
+	size, err := io.Copy(io.MultiWriter(tmp, hash, sniff), io.LimitReader(resp.Body, maxImageSize+1))
+	downloadBytes.Add(float64(size))
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	if size > maxImageSize {
+		return ImageInfo{}, fmt.Errorf("image of more than the %d bytes allowed", maxImageSize)
+	}
+	if resp.ContentLength >= 0 && size != resp.ContentLength {
+		return ImageInfo{}, fmt.Errorf("incomplete download, got %d of %d bytes", size, resp.ContentLength)
+	}
+	if size == 0 {
+		return ImageInfo{}, fmt.Errorf("empty image")
+	}
+
+	mimeType, err := imageType(resp.Header.Get("Content-Type"), sniff.buf)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info := ImageInfo{
+		Hash: hex.EncodeToString(hash.Sum(nil)),
+		Size: size,
+		MIME: mimeType,
+	}
+
+	// A cover no entry uses may be swept, unless it's claimed first
+	if err := claimCover(db, info.Hash); err != nil {
+		return ImageInfo{}, err
+	}
+	key := blobKey(info.Hash)
+	exists, err := store.Exists(key)
+	if err != nil || exists {
+		return info, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return ImageInfo{}, err
+	}
+	return info, store.Put(key, tmp, size, info.MIME)
+}
+
+// Keeps the first bytes written to it, enough for http.DetectContentType
+type sniffWriter struct {
+	buf []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if n := 512 - len(w.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// The body has to sniff as an image, whatever upstream says it is. Its
+// Content-Type is kept if it names an image too, being more precise.
+func imageType(header string, head []byte) (string, error) {
+	sniffed := http.DetectContentType(head)
+	if !strings.HasPrefix(sniffed, "image/") {
+		return "", fmt.Errorf("not an image, looks like %s", sniffed)
+	}
+	if mediaType, _, err := mime.ParseMediaType(header); err == nil && strings.HasPrefix(mediaType, "image/") {
+		return mediaType, nil
+	}
+	return sniffed, nil
+}
+
+func getFilename(src string) string {
+	url := strings.Split(src, "/")
+	if len(url) < 1 {
+		log.Fatalf("invalid url %s\n", src)
+	}
+	return url[len(url)-1]
+}
+
+// Browsers and proxies may keep covers for a day, and revalidate with the ETag
+const imageCacheControl = "public, max-age=86400"
+
+// Serve a cover by its entry ID or by the filename it had upstream. The entry
+// tells where its blob is, which is either streamed or, in redirect mode and
+// if the store can, redirected to. Entries which haven't been downloaded
+// again since images were content addressed are served from their old file.
+//
+// With any of w, h, fit or format in the query, a resized copy is served
+// instead, see serveThumb.
+func (e *Env) serveImage(c *gin.Context) {
+	name := c.Param("name")
+
+	spec, resized, err := parseThumbSpec(c.Query("w"), c.Query("h"), c.Query("fit"), c.Query("format"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	var data Data
+	if id, convErr := strconv.Atoi(name); convErr == nil {
+		err = e.db.One("ID", id, &data)
+	} else {
+		err = e.db.One("Filename", name, &data)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	if err == storm.ErrNotFound {
+		// Not in DB anymore, but older versions may still have the file
+		data = Data{Filename: name}
+	}
+
+	if data.Hash == "" {
+		data.MIME = mime.TypeByExtension(filepath.Ext(data.Filename))
+		if _, err := os.Stat(legacyPath(data.Filename)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "No such image"})
+			return
+		}
+	}
+
+	if resized {
+		e.serveThumb(c, data, spec)
+		return
+	}
+	if data.Hash == "" {
+		c.File(legacyPath(data.Filename))
+		return
+	}
+	e.serveBlob(c, data)
+}
+
+// filepath.Base keeps the name from escaping imageDir
+func legacyPath(filename string) string {
+	return filepath.Join(imageDir, filepath.Base(filename))
+}
+
+// Answers 304 if the client already has etag
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", imageCacheControl)
+	if etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Serve a resized copy of the cover of data. Thumbnails are cached on disk by
+// the cover and the spec, so each size is only made once.
+func (e *Env) serveThumb(c *gin.Context, data Data, spec ThumbSpec) {
+	source := ""
+	if data.MIME == "image/png" {
+		source = "png"
+	}
+	format := spec.outputFormat(source)
+
+	// Legacy files have no hash, their name and size stand for it
+	tag := data.Hash
+	if tag == "" {
+		info, err := os.Stat(legacyPath(data.Filename))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"message": "No such image"})
+			return
+		}
+		tag = fmt.Sprintf("legacy:%s:%d:%d", data.Filename, info.Size(), info.ModTime().Unix())
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s", tag, spec.Width, spec.Height, spec.Fit, format)))
+	key := hex.EncodeToString(sum[:]) + "." + format
+
+	if notModified(c, `"`+key+`"`) {
+		return
+	}
+	c.Header("Content-Type", "image/"+format)
+
+	if f, ok := e.thumbs.Get(key); ok {
+		defer f.Close()
+		var modTime time.Time
+		if info, err := f.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+		http.ServeContent(c.Writer, c.Request, key, modTime, f)
+		return
+	}
+
+	// Resizing is CPU heavy, don't run more of them than there are CPUs
+	e.resizing <- struct{}{}
+	thumb, err := e.makeThumb(data, spec, format)
+	<-e.resizing
+	if err == ErrBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No such image"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		return
+	}
+	if err := e.thumbs.Put(key, thumb); err != nil {
+		requestLog(c).Warn("Can't cache the thumbnail", "key", key, "error", err)
+	}
+	c.Data(http.StatusOK, "image/"+format, thumb)
+}
+
+func (e *Env) makeThumb(data Data, spec ThumbSpec, format string) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	if data.Hash != "" {
+		r, err = e.store.Get(blobKey(data.Hash))
+	} else {
+		r, err = os.Open(legacyPath(data.Filename))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var thumb bytes.Buffer
+	if err := makeThumb(&thumb, src, spec, format); err != nil {
+		return nil, err
+	}
+	return thumb.Bytes(), nil
+}
+
+func (e *Env) serveBlob(c *gin.Context, data Data) {
+	key := blobKey(data.Hash)
+	// The content hash makes for a strong validator
+	if notModified(c, `"`+data.Hash+`"`) {
+		return
+	}
+
+	if settings := e.settings(); settings.imageServe == serveRedirect {
+		url, err := e.store.URL(key, settings.imageURLTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		if url != "" {
+			c.Redirect(http.StatusTemporaryRedirect, url)
+			return
+		}
+	}
+
+	blob, err := e.store.Get(key)
+	if err == ErrBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"message": "No such image"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	defer blob.Close()
+
+	c.Header("Content-Type", data.MIME)
+	// Local files can seek, which gets us range requests for free
+	if rs, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, data.Filename, blob.ModTime(), rs)
+		return
+	}
+	if blob.Size() >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(blob.Size(), 10))
+	}
+	if !blob.ModTime().IsZero() {
+		c.Header("Last-Modified", blob.ModTime().UTC().Format(http.TimeFormat))
+	}
+	c.Status(http.StatusOK)
+	if c.Request.Method != http.MethodHead {
+		io.Copy(c.Writer, blob)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadImageRefuses(t *testing.T) {
+	old := maxImageSize
+	maxImageSize = 1024
+	defer func() { maxImageSize = old }()
+
+	big := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 2048)...)
+	images := newImageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(big)
+		case "/chunked.png":
+			// No Content-Length, the body has to be cut
+			w.Header().Set("Content-Type", "image/png")
+			for i := 0; i < len(big); i += 256 {
+				w.Write(big[i : i+256])
+				w.(http.Flusher).Flush()
+			}
+		case "/admin.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("<html><body>internal</body></html>"))
+		default:
+			servePNG(w, r)
+		}
+	})
+	db := newTestDB(t)
+	client := NewClient(5*time.Second, 0)
+	store := NewLocalStore(t.TempDir())
+
+	for _, tt := range []struct {
+		path, err string
+	}{
+		{"/big.png", "more than"},
+		{"/chunked.png", "more than"},
+		{"/admin.png", "not an image"},
+	} {
+		_, err := downloadImage(context.Background(), db, client, store, images.URL+tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.path, err, tt.err)
+		}
+	}
+
+	info, err := downloadImage(context.Background(), db, client, store, images.URL+"/small.png")
+	if err != nil || info.MIME != "image/png" {
+		t.Fatalf("small.png = %+v, %v, want a PNG", info, err)
+	}
+	if ok, err := store.Exists(blobKey(info.Hash)); !ok || err != nil {
+		t.Errorf("small.png isn't stored: %v", err)
+	}
+}
+
+// A PNG whose header claims it is w by h
+func pngClaiming(w, h uint32) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	b := buf.Bytes()
+	// IHDR's data starts after the signature, its length and its type
+	binary.BigEndian.PutUint32(b[16:], w)
+	binary.BigEndian.PutUint32(b[20:], h)
+	binary.BigEndian.PutUint32(b[29:], crc32.ChecksumIEEE(b[12:29]))
+	return b
+}
+
+func TestMakeThumbChecksTheSizeFirst(t *testing.T) {
+	spec := ThumbSpec{Width: 10}
+	var thumb bytes.Buffer
+	for _, size := range [][2]uint32{{100000, 100000}, {60000, 1000}} {
+		err := makeThumb(&thumb, pngClaiming(size[0], size[1]), spec, "png")
+		if err == nil || !strings.Contains(err.Error(), "too big") {
+			t.Errorf("%dx%d: err = %v, want too big", size[0], size[1], err)
+		}
+	}
+	if err := makeThumb(&thumb, pngClaiming(1, 1), spec, "png"); err != nil {
+		t.Errorf("1x1: %v", err)
+	}
+}
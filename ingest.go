@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// How many pages of creators a crawl walks through, unless crawl.pages says
+// otherwise
+const defaultCrawlPages = 10
+
+// Bucket holding one Checkpoint per provider
+const checkpointBucket = "checkpoints"
+
+// Checkpoint remembers how far the last crawl of a provider went, so an
+// interrupted crawl resumes instead of starting over.
+type Checkpoint struct {
+	// The page being crawled, 0 means there is nothing to resume
+	Page int `json:"page"`
+	// The last creator of Page that has been fully processed
+	Creator   string    `json:"creator"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func loadCheckpoint(db *storm.DB, provider string) (Checkpoint, error) {
+	var cp Checkpoint
+	err := db.Get(checkpointBucket, provider, &cp)
+	if err == storm.ErrNotFound {
+		return Checkpoint{}, nil
+	}
+	return cp, err
+}
+
+func saveCheckpoint(db *storm.DB, provider string, cp Checkpoint) error {
+	cp.UpdatedAt = time.Now()
+	return db.Set(checkpointBucket, provider, &cp)
+}
+
+func clearCheckpoint(db *storm.DB, provider string) error {
+	err := db.Delete(checkpointBucket, provider)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Walks the first pages of creators of the provider, and stores the cover
+// of the latest project of each creator. It picks up from the stored
+// checkpoint if the previous crawl didn't finish. Every line logged by the
+// crawl, down to the downloads, carries the ID of the run.
+func (cr *Crawler) fetchItem(ctx context.Context) (CrawlResult, error) {
+	start := time.Now()
+	result := CrawlResult{RunID: newID()}
+	log := logFrom(ctx).With("run_id", result.RunID, "provider", cr.provider.Name())
+	ctx = withLog(ctx, log)
+	log.Info("Crawl started", "pages", cr.pages, "workers", cr.workers)
+
+	pipeline := NewPipeline(ctx, cr.db, cr.client, cr.store, cr.workers)
+	err := cr.crawl(ctx, pipeline, &result)
+
+	saved, failures := pipeline.Close()
+	result.Saved = saved
+	result.Errors = append(result.Errors, failures...)
+	name := cr.provider.Name()
+	crawlSaved.Add(float64(saved), name)
+	crawlFailed.Add(float64(len(result.Errors)), name)
+	crawlDuration.ObserveSince(start, name)
+	switch {
+	case err == context.Canceled:
+		crawlRuns.Inc(name, "interrupted")
+		log.Info("Crawl interrupted, the next one resumes from where it was", "saved", saved, "failed", len(result.Errors))
+	case err != nil:
+		crawlRuns.Inc(name, "stopped")
+		log.Error("Crawl stopped, the next one resumes from where it was", "error", err, "saved", saved, "failed", len(result.Errors))
+	default:
+		crawlRuns.Inc(name, "done")
+		log.Info("Crawl done", "saved", saved, "failed", len(result.Errors))
+	}
+	return result, err
+}
+
+// foli crawl [-pages n] [-workers n], crawls once and exits
+func crawlCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	pages := flags.Int("pages", cfg.Crawl.Pages, "pages of creators to walk through")
+	workers := flags.Int("workers", cfg.Crawl.Workers, "covers downloaded at once")
+	flags.Parse(args)
+	cfg.Crawl.Pages, cfg.Crawl.Workers = *pages, *workers
+	if err := cfg.validate(true); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	db := openDB(cfg)
+	defer db.Close()
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := ensureSearchIndex(db); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	client := NewClient(cfg.HTTP.Timeout, cfg.HTTP.Retries)
+	crawler := &Crawler{
+		provider: newProvider(cfg, client),
+		db:       db,
+		client:   client,
+		store:    newBlobStore(cfg),
+		workers:  cfg.Crawl.Workers,
+		pages:    cfg.Crawl.Pages,
+	}
+	// Ctrl-C stops the crawl where it is, keeping what was saved
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Stopping", "signal", sig.String())
+		cancel()
+	}()
+
+	result, err := crawler.fetchItem(ctx)
+	if err != nil || len(result.Errors) > 0 {
+		// os.Exit skips the deferred close
+		db.Close()
+		os.Exit(1)
+	}
+}
+
+// Crawler is everything a crawl needs
+type Crawler struct {
+	provider Provider
+	db       *storm.DB
+	client   *Client
+	store    BlobStore
+	workers  int
+	pages    int
+}
+
+// CrawlResult sums up what a single crawl did
+type CrawlResult struct {
+	// Found in every line the crawl logged
+	RunID string
+	Saved int
+	// Creators or covers that couldn't be fetched, downloaded or saved
+	Errors []error
+}
+
+func (cr *Crawler) crawl(ctx context.Context, pipeline *Pipeline, result *CrawlResult) error {
+	p, db, log := cr.provider, cr.db, logFrom(ctx)
+	cp, err := loadCheckpoint(db, p.Name())
+	if err != nil {
+		return err
+	}
+	startPage, lastCreator := 1, ""
+	if cp.Page > 0 {
+		startPage, lastCreator = cp.Page, cp.Creator
+		log.Info("Resuming crawl", "page", startPage, "after_creator", lastCreator)
+	}
+
+	for page := startPage; page <= cr.pages; page++ {
+		creators, err := p.ListCreators(ctx, page)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// Keep the checkpoint, the next crawl retries this page
+			return err
+		}
+		if page == startPage {
+			creators = creatorsAfter(creators, lastCreator)
+		}
+
+		for j, creator := range creators {
+			// Stopping, the checkpoint stays at the last page done
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Debug("Fetching creator", "page", page, "pages", cr.pages, "creator", j+1, "username", creator.Username)
+			data, err := fetchCreator(ctx, p, creator)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Warn("Fetching creator failed", "username", creator.Username, "error", err)
+				result.Errors = append(result.Errors, fmt.Errorf("%s: %s", creator.Username, err))
+				continue
+			}
+			if data == nil {
+				continue
+			}
+			crawlProjects.Inc(p.Name())
+			// Curators deleted it, don't bring it back
+			dropped, err := isDropped(db, upstreamKey(data.Provider, data.UpstreamID))
+			if err != nil {
+				return err
+			}
+			if !dropped {
+				pipeline.Submit(*data)
+			}
+		}
+
+		// Only move the checkpoint once the whole page has been saved.
+		// Downloads interrupted on the way were skipped, not saved.
+		pipeline.Wait()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Info("Page done", "page", page, "pages", cr.pages)
+		if len(creators) > 0 {
+			last := creators[len(creators)-1]
+			if err := saveCheckpoint(db, p.Name(), Checkpoint{Page: page, Creator: last.ID}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// A full pass is done, the next crawl starts from the first page again
+	return clearCheckpoint(db, p.Name())
+}
+
+// The creators coming after the last one processed. If last isn't in the
+// page anymore (the upstream list moved), the whole page is done again,
+// that's cheap since saving is idempotent.
+func creatorsAfter(creators []Creator, last string) []Creator {
+	if last == "" {
+		return creators
+	}
+	for i, creator := range creators {
+		if creator.ID == last {
+			return creators[i+1:]
+		}
+	}
+	return creators
+}
+
+// Resolves the cover of the latest project of creator, nil if there is none
+func fetchCreator(ctx context.Context, p Provider, creator Creator) (*Data, error) {
+	projects, err := p.ListProjects(ctx, creator)
+	if err != nil {
+		return nil, err
+	}
+	if len(projects) == 0 {
+		return nil, nil
+	}
+	cover, err := p.ResolveCover(ctx, projects[0])
+	if err != nil {
+		return nil, err
+	}
+
+	data := Data{
+		Title:       cover.Title,
+		Description: cover.Description,
+		Filename:    getFilename(cover.Src),
+		Src:         cover.Src,
+		Provider:    p.Name(),
+		UpstreamID:  cover.ProjectID,
+		Metadata:    cover.Metadata,
+	}
+	return &data, nil
+}
+
+func upstreamKey(provider, upstreamID string) string {
+	return provider + ":" + upstreamID
+}
+
+// Bucket of the upstream keys of crawled entries deleted through the API
+const droppedBucket = "dropped"
+
+func isDropped(db *storm.DB, key string) (bool, error) {
+	dropped, err := db.KeyExists(droppedBucket, key)
+	if err == storm.ErrNotFound {
+		return false, nil
+	}
+	return dropped, err
+}
+
+// Saves data, replacing the row of the same upstream project if there is one.
+// Rows stored before upstream IDs existed are matched by their Src instead.
+// The search index and the orphaned covers are updated in the same
+// transaction.
+func upsert(db *storm.DB, data *Data) error {
+	data.UpstreamKey = upstreamKey(data.Provider, data.UpstreamID)
+
+	return db.Bolt.Update(func(btx *bolt.Tx) error {
+		tx := db.WithTransaction(btx)
+
+		var existing Data
+		err := tx.One("UpstreamKey", data.UpstreamKey, &existing)
+		if err == storm.ErrNotFound {
+			err = findLegacy(tx, data.Src, &existing)
+		}
+
+		now := time.Now()
+		// The covers this save lets go of
+		var released []string
+		switch err {
+		case nil:
+			data.ID = existing.ID
+			data.CreatedAt = existing.CreatedAt
+			if data.CreatedAt.IsZero() {
+				data.CreatedAt = now
+			}
+			// What curators fixed by hand wins over upstream, the cover
+			// just downloaded isn't used then
+			if existing.Curated {
+				released = append(released, data.Hash)
+				data.Title = existing.Title
+				data.Description = existing.Description
+				data.Src, data.Filename = existing.Src, existing.Filename
+				data.Hash, data.Size, data.MIME = existing.Hash, existing.Size, existing.MIME
+				data.Curated = true
+			}
+			released = append(released, existing.Hash)
+		case storm.ErrNotFound:
+			data.ID = 0
+			data.CreatedAt = now
+		default:
+			return err
+		}
+		data.UpdatedAt = now
+
+		if err := tx.Save(data); err != nil {
+			return err
+		}
+		if err := keepCover(tx, data.Hash); err != nil {
+			return err
+		}
+		for _, hash := range released {
+			if hash == data.Hash {
+				continue
+			}
+			if err := releaseCover(tx, hash); err != nil {
+				return err
+			}
+		}
+		if err := bumpChanges(tx); err != nil {
+			return err
+		}
+		return indexDocument(btx, data)
+	})
+}
+
+// Finds a row with the given src that doesn't have an upstream key yet, and
+// wasn't added by hand either
+func findLegacy(tx storm.Node, src string, to *Data) error {
+	var rows []Data
+	if err := tx.Find("Src", src, &rows); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.UpstreamKey == "" && row.Provider == "" {
+			*to = row
+			return nil
+		}
+	}
+	return storm.ErrNotFound
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A small PNG of its own for every path, so each cover has its own hash
+func servePNG(w http.ResponseWriter, r *http.Request) {
+	h := fnv.New32a()
+	h.Write([]byte(r.URL.Path))
+	sum := h.Sum32()
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = byte(sum >> uint(8*(i%4)))
+	}
+	img.Set(0, 0, color.RGBA{A: 255})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+func newImageServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	if handler == nil {
+		handler = servePNG
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testProvider has pages of creators with one project each, whose cover is
+// <images>/<creator id>.png
+type testProvider struct {
+	pages  [][]Creator
+	images string
+	// ListCreators fails for that page, once
+	failPage int
+
+	mu       sync.Mutex
+	projects []string
+}
+
+func newTestProvider(images string, pages ...int) *testProvider {
+	p := &testProvider{images: images}
+	n := 0
+	for _, size := range pages {
+		var creators []Creator
+		for i := 0; i < size; i++ {
+			n++
+			creators = append(creators, Creator{ID: fmt.Sprintf("c%d", n), Username: fmt.Sprintf("user%d", n)})
+		}
+		p.pages = append(p.pages, creators)
+	}
+	return p
+}
+
+func (p *testProvider) Name() string { return "test" }
+
+func (p *testProvider) ListCreators(ctx context.Context, page int) ([]Creator, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if page == p.failPage {
+		p.failPage = 0
+		return nil, fmt.Errorf("page %d is down", page)
+	}
+	if page > len(p.pages) {
+		return nil, nil
+	}
+	return p.pages[page-1], nil
+}
+
+func (p *testProvider) ListProjects(ctx context.Context, creator Creator) ([]string, error) {
+	p.mu.Lock()
+	p.projects = append(p.projects, creator.ID)
+	p.mu.Unlock()
+	return []string{"p" + creator.ID}, nil
+}
+
+func (p *testProvider) ResolveCover(ctx context.Context, projectID string) (Cover, error) {
+	id := strings.TrimPrefix(projectID, "p")
+	return Cover{
+		ProjectID: projectID,
+		Title:     "Project of " + id,
+		Src:       p.images + "/" + id + ".png",
+	}, nil
+}
+
+// The creators whose projects were listed since the last call
+func (p *testProvider) listed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	listed := p.projects
+	p.projects = nil
+	return listed
+}
+
+func newTestCrawler(t *testing.T, p Provider, pages int) *Crawler {
+	return &Crawler{
+		provider: p,
+		db:       newTestDB(t),
+		client:   NewClient(5*time.Second, 0),
+		store:    NewLocalStore(t.TempDir()),
+		workers:  2,
+		pages:    pages,
+	}
+}
+
+func TestUpsertUpdatesTheSameProject(t *testing.T) {
+	db := newTestDB(t)
+	first := Data{Title: "First", Provider: "test", UpstreamID: "1", Src: "http://example.com/1.png", Hash: "aaaa"}
+	if err := upsert(db, &first); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		again := Data{Title: fmt.Sprintf("Renamed %d", i), Provider: "test", UpstreamID: "1", Src: "http://example.com/1.png", Hash: "aaaa"}
+		if err := upsert(db, &again); err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != first.ID || !again.CreatedAt.Equal(first.CreatedAt) || !again.UpdatedAt.After(first.CreatedAt) {
+			t.Errorf("upsert %d: id %d created %s updated %s, want id %d created %s", i, again.ID, again.CreatedAt, again.UpdatedAt, first.ID, first.CreatedAt)
+		}
+	}
+	// The same upstream ID from another provider is another project
+	other := Data{Title: "Other", Provider: "elsewhere", UpstreamID: "1", Src: "http://example.com/1.png", Hash: "aaaa"}
+	if err := upsert(db, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []Data
+	if err := db.All(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Title != "Renamed 2" || rows[1].Title != "Other" {
+		t.Errorf("rows = %+v, want Renamed 2 and Other", rows)
+	}
+}
+
+func TestUpsertAdoptsLegacyRows(t *testing.T) {
+	db := newTestDB(t)
+	legacy := Data{Title: "Old", Src: "http://example.com/1.png", Filename: "1.png"}
+	if err := db.Save(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	manual := Data{Title: "By hand", Provider: manualProvider, Src: "http://example.com/1.png", Curated: true}
+	if err := db.Save(&manual); err != nil {
+		t.Fatal(err)
+	}
+
+	data := Data{Title: "New", Provider: "test", UpstreamID: "1", Src: "http://example.com/1.png"}
+	if err := upsert(db, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.ID != legacy.ID || data.UpstreamKey != "test:1" {
+		t.Errorf("saved as %d %q, want the legacy row %d with its upstream key", data.ID, data.UpstreamKey, legacy.ID)
+	}
+	var kept Data
+	if err := db.One("ID", manual.ID, &kept); err != nil || kept.Title != "By hand" {
+		t.Errorf("the row added by hand = %+v, %v, want it untouched", kept, err)
+	}
+}
+
+func TestCrawlResumesFromCheckpoint(t *testing.T) {
+	images := newImageServer(t, nil)
+	p := newTestProvider(images.URL, 2, 2, 2)
+	cr := newTestCrawler(t, p, 3)
+	p.failPage = 2
+
+	result, err := cr.fetchItem(context.Background())
+	if err == nil {
+		t.Fatal("the crawl went on past a page that failed")
+	}
+	if result.Saved != 2 {
+		t.Errorf("first crawl saved %d, want the 2 of page 1", result.Saved)
+	}
+	cp, err := loadCheckpoint(cr.db, "test")
+	if err != nil || cp.Page != 1 || cp.Creator != "c2" {
+		t.Fatalf("checkpoint = %+v, %v, want page 1 after c2", cp, err)
+	}
+	p.listed()
+
+	result, err = cr.fetchItem(context.Background())
+	if err != nil || result.Saved != 4 {
+		t.Fatalf("second crawl saved %d, %v, want 4", result.Saved, err)
+	}
+	if listed := strings.Join(p.listed(), ","); listed != "c3,c4,c5,c6" {
+		t.Errorf("second crawl listed the projects of %s, want c3,c4,c5,c6", listed)
+	}
+	if cp, err := loadCheckpoint(cr.db, "test"); err != nil || cp.Page != 0 {
+		t.Errorf("checkpoint after a full pass = %+v, %v, want none", cp, err)
+	}
+
+	// A full crawl again only refreshes the rows
+	if _, err := cr.fetchItem(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cr.db.Count(&Data{}); err != nil || n != 6 {
+		t.Errorf("%d rows, %v, want 6", n, err)
+	}
+}
+
+func TestCreatorsAfter(t *testing.T) {
+	creators := []Creator{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	for _, tt := range []struct {
+		last string
+		want int
+	}{
+		{"", 3},
+		{"1", 2},
+		{"3", 0},
+		// Gone from the page, it's done again
+		{"9", 3},
+	} {
+		if got := creatorsAfter(creators, tt.last); len(got) != tt.want {
+			t.Errorf("creatorsAfter(%s) = %d creators, want %d", tt.last, len(got), tt.want)
+		}
+	}
+}
+
+// Cancels the crawl once it has stored a cover
+type cancelingStore struct {
+	BlobStore
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	keys []string
+}
+
+func (s *cancelingStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	err := s.BlobStore.Put(key, r, size, contentType)
+	s.mu.Lock()
+	s.keys = append(s.keys, key)
+	s.mu.Unlock()
+	s.cancel()
+	return err
+}
+
+func TestInterruptedCrawlSavesWhatWasDownloaded(t *testing.T) {
+	images := newImageServer(t, nil)
+	cr := newTestCrawler(t, newTestProvider(images.URL, 3, 3), 2)
+	cr.workers = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	store := &cancelingStore{BlobStore: cr.store, cancel: cancel}
+	cr.store = store
+
+	result, err := cr.fetchItem(ctx)
+	if err != context.Canceled {
+		t.Fatalf("crawl err = %v, want context.Canceled", err)
+	}
+	if len(store.keys) == 0 {
+		t.Fatal("nothing was downloaded")
+	}
+	if result.Saved != len(store.keys) || len(result.Errors) != 0 {
+		t.Errorf("saved %d with %d errors, want the %d covers downloaded and no error", result.Saved, len(result.Errors), len(store.keys))
+	}
+	for _, key := range store.keys {
+		hash := key[strings.LastIndex(key, "/")+1:]
+		var row Data
+		if err := cr.db.One("Hash", hash, &row); err != nil {
+			t.Errorf("no entry for the downloaded cover %s: %v", hash, err)
+		}
+	}
+	if cp, err := loadCheckpoint(cr.db, "test"); err != nil || cp.Page != 0 {
+		t.Errorf("checkpoint = %+v, %v, want none, page 1 wasn't done", cp, err)
+	}
+}
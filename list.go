@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/gin-gonic/gin"
+)
+
+// Page size of GET /, unless ?limit= says otherwise
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Query parameters of GET / which aren't filters
+var listParams = map[string]bool{"cursor": true, "limit": true, "fields": true, "sort": true}
+
+// A page of GET /, see parseListRequest
+type listRequest struct {
+	cursor int
+	limit  int
+	desc   bool
+	fields []string
+	filter Filter
+}
+
+// Parses ?cursor=&limit=&sort=&fields= and the filters, which are either
+// field=value for an exact match or field.op=value with the operators of
+// POST /q, e.g. ?provider=behance&id.gt=10&title.prefix=Soum. in takes
+// comma separated values.
+func parseListRequest(query url.Values) (listRequest, error) {
+	req := listRequest{limit: defaultPageSize, filter: Filter{Where: make(map[string]Condition)}}
+	var err error
+
+	if v := query.Get("cursor"); v != "" {
+		if req.cursor, err = strconv.Atoi(v); err != nil || req.cursor < 0 {
+			return req, fmt.Errorf("cursor should be the id the previous page ended with")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if req.limit, err = strconv.Atoi(v); err != nil || req.limit < 1 || req.limit > maxPageSize {
+			return req, fmt.Errorf("limit should be between 1 and %d", maxPageSize)
+		}
+	}
+	switch query.Get("sort") {
+	case "", "id":
+	case "-id":
+		req.desc = true
+	default:
+		return req, fmt.Errorf("sort should be id or -id, pages follow the id")
+	}
+	if v := query.Get("fields"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			if _, ok := queryFields[field]; !ok {
+				return req, fmt.Errorf("unknown field %s, use some of %s", field, queryFieldNames())
+			}
+			req.fields = append(req.fields, field)
+		}
+	}
+
+	for param, values := range query {
+		if listParams[param] {
+			continue
+		}
+		field, op := param, "eq"
+		if i := strings.LastIndex(param, "."); i >= 0 {
+			field, op = param[:i], param[i+1:]
+		}
+		f, ok := queryFields[field]
+		if !ok {
+			return req, fmt.Errorf("unknown filter %s, use one of %s", field, queryFieldNames())
+		}
+
+		cond := req.filter.Where[field]
+		raw := values[0]
+		if op == "in" {
+			for _, v := range strings.Split(raw, ",") {
+				val, err := paramValue(f, v)
+				if err != nil {
+					return req, err
+				}
+				cond.In = append(cond.In, val)
+			}
+			req.filter.Where[field] = cond
+			continue
+		}
+
+		val, err := paramValue(f, raw)
+		if err != nil {
+			return req, err
+		}
+		switch op {
+		case "eq":
+			cond.Eq = val
+		case "ne":
+			cond.Ne = val
+		case "gt":
+			cond.Gt = val
+		case "gte":
+			cond.Gte = val
+		case "lt":
+			cond.Lt = val
+		case "lte":
+			cond.Lte = val
+		case "re":
+			cond.Re = raw
+		case "prefix":
+			cond.Prefix = raw
+		default:
+			return req, fmt.Errorf("unknown operator %s, use eq, ne, in, re, prefix, gt, gte, lt or lte", op)
+		}
+		req.filter.Where[field] = cond
+	}
+	return req, nil
+}
+
+// Query parameters are strings, numbers are parsed here the rest is left to
+// fieldValue like for POST /q.
+func paramValue(f queryField, raw string) (interface{}, error) {
+	if f.kind != numberField {
+		return raw, nil
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s should be a number, got %s", f.name, raw)
+	}
+	return n, nil
+}
+
+// List the entries in DB, a page at a time. The body is the array of
+// entries as before, streamed as they are read. How to get the next page is
+// in the headers: X-Total-Count has how many entries match, X-Next-Cursor
+// and Link the URL of the next page, if there is one.
+func (e *Env) queryAll(c *gin.Context) {
+	req, err := parseListRequest(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	matcher, err := req.filter.matcher()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	total, err := e.db.Select(matcher).Count(&Data{})
+	if err != nil && err != storm.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Pages go by id, the cursor is the last id of the previous page
+	page := matcher
+	if req.cursor > 0 {
+		if req.desc {
+			page = q.And(matcher, q.Lt("ID", req.cursor))
+		} else {
+			page = q.And(matcher, q.Gt("ID", req.cursor))
+		}
+	}
+	// IDs are the keys of the bucket, stored big endian, so walking it is
+	// already in id order. Asking storm to OrderBy would sort in memory.
+	selection := func() storm.Query {
+		s := e.db.Select(page)
+		if req.desc {
+			s = s.Reverse()
+		}
+		return s
+	}
+
+	// Only the last entry of this page and whether there is one after it are
+	// read, so nothing but one entry is held in memory at a time.
+	var last Data
+	err = selection().Skip(req.limit - 1).First(&last)
+	if err == nil {
+		more, err := selection().Skip(req.limit).Count(&Data{})
+		if err == nil && more > 0 {
+			next := c.Request.URL.Query()
+			next.Set("cursor", strconv.Itoa(last.ID))
+			next.Set("limit", strconv.Itoa(req.limit))
+			c.Header("X-Next-Cursor", strconv.Itoa(last.ID))
+			c.Header("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", c.Request.URL.Path, next.Encode()))
+		}
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	w.WriteString("[")
+	n := 0
+	err = selection().Limit(req.limit).Each(new(Data), func(record interface{}) error {
+		b, err := projectFields(record.(*Data), req.fields)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			w.WriteString(",")
+		}
+		n++
+		_, err = w.Write(b)
+		return err
+	})
+	if err != nil && err != storm.ErrNotFound {
+		// Too late to change the status, the client gets a broken array
+		requestLog(c).Error("Listing failed halfway", "error", err)
+		return
+	}
+	w.WriteString("]")
+}
+
+// The JSON of data, with only the given fields if there are any
+func projectFields(data *Data, fields []string) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil || len(fields) == 0 {
+		return b, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		name, _ := json.Marshal(field)
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(all[field])
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
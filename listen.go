@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Addresses starting with it are Unix sockets, e.g. unix:/run/foli.sock
+const unixPrefix = "unix:"
+
+// Owner and group may connect to the Unix sockets, unless socket_mode says
+// otherwise
+const defaultSocketMode = "0660"
+
+// How often the TLS files are checked for changes, unless tls.reload_interval
+// says otherwise
+const defaultTLSReloadInterval = 10 * time.Second
+
+// The addresses of a listen setting, separated by commas
+func listenAddrs(listen string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(listen, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Why addr can't be listened on, nil when it can
+func checkListenAddr(addr string) error {
+	if strings.HasPrefix(addr, unixPrefix) {
+		if strings.TrimPrefix(addr, unixPrefix) == "" {
+			return fmt.Errorf("unix: should be followed by the path of the socket")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("should be host:port, :port or unix:/path/to.sock, got \"%s\"", addr)
+	}
+	return nil
+}
+
+// Permissions like 0660
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("should be permissions in octal like 0660, got \"%s\"", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Listens on a TCP address or a Unix socket. A socket left behind by a
+// process that didn't stop cleanly is replaced, anything else at its path
+// is an error. Sockets get mode as their permissions.
+func listenOn(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// It's made with the umask, which may let anyone connect
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// Numbers the connections to a Unix socket. They have no address of their
+// own, so each one gets unix:<socket>#<n> to be told apart, e.g. by the
+// rate limit.
+type unixListener struct {
+	net.Listener
+	path  string
+	conns uint64
+}
+
+func (l *unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddUint64(&l.conns, 1)
+	return &unixConn{Conn: conn, addr: unixAddr(fmt.Sprintf("%s%s#%d", unixPrefix, l.path, n))}, nil
+}
+
+type unixConn struct {
+	net.Conn
+	addr unixAddr
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type unixAddr string
+
+func (a unixAddr) Network() string { return "unix" }
+func (a unixAddr) String() string  { return string(a) }
+
+// CertReloader serves the certificate of tls.cert and tls.key, and checks
+// the client certificates against tls.client_ca. The files are loaded again
+// when they change on disk, so renewed certificates are picked up without
+// a restart. Handshakes keep using the last files that loaded fine.
+type CertReloader struct {
+	certFile, keyFile, caFile string
+	http2                     bool
+
+	mu     sync.RWMutex
+	config *tls.Config
+	// Modification times and sizes of the files when they were loaded
+	stamps []string
+}
+
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	r := &CertReloader{certFile: cfg.Cert, keyFile: cfg.Key, caFile: cfg.ClientCA, http2: cfg.HTTP2}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// Stamps of the files, they change whenever one is written or replaced
+func (r *CertReloader) stat() ([]string, error) {
+	var stamps []string
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return stamps, nil
+}
+
+func (r *CertReloader) load() error {
+	stamps, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls.cert and tls.key: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("tls.cert: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	if r.http2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("tls.client_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls.client_ca: no PEM certificate in %s", r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.mu.Lock()
+	r.config, r.stamps = config, stamps
+	r.mu.Unlock()
+	logger.Info("Loaded the TLS certificate", "subject", leaf.Subject.String(), "expires", leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// Loads the files again if they changed since the last time
+func (r *CertReloader) Reload() {
+	stamps, err := r.stat()
+	if err == nil {
+		r.mu.RLock()
+		same := strings.Join(stamps, ",") == strings.Join(r.stamps, ",")
+		r.mu.RUnlock()
+		if same {
+			return
+		}
+		err = r.load()
+	}
+	if err != nil {
+		// Often a renewal caught halfway, the next check gets the rest
+		logger.Error("Can't reload the TLS certificate, keeping the current one", "error", err)
+	}
+}
+
+// Checks the files for changes every interval, until stop is closed
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.Reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// The config of the server, each handshake gets the latest certificate
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenOnSocketMode(t *testing.T) {
+	// Whatever the umask would let through
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	for _, mode := range []os.FileMode{0660, 0600} {
+		path := filepath.Join(t.TempDir(), "foli.sock")
+		ln, err := listenOn(unixPrefix+path, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			t.Errorf("socket mode = %o, want %o", got, mode)
+		}
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	if mode, err := parseSocketMode(defaultSocketMode); err != nil || mode != 0660 {
+		t.Errorf("parseSocketMode(%s) = %o, %v, want 660", defaultSocketMode, mode, err)
+	}
+	for _, mode := range []string{"", "rw-rw----", "0999", "1777"} {
+		if _, err := parseSocketMode(mode); err == nil {
+			t.Errorf("parseSocketMode(%q): no error", mode)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Level of a log line, lines below the level of the logger are dropped
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("log level should be debug, info, warn or error, got \"%s\"", name)
+}
+
+// Logger writes leveled log lines, as JSON objects or as text for people.
+// With returns a child logger adding fields to every line, e.g. the ID of the
+// crawl run or of the request. Children share the level of their parent, so
+// changing it at runtime affects them all.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  *int32
+	text   bool
+	fields []interface{}
+}
+
+func NewLogger(out io.Writer, level Level, format string) *Logger {
+	lvl := int32(level)
+	return &Logger{out: out, mu: &sync.Mutex{}, level: &lvl, text: format == "text"}
+}
+
+// Logs to stderr, masking secrets. Replaced once the config is loaded.
+var logger = NewLogger(redactingWriter{os.Stderr}, LevelInfo, "json")
+
+func (l *Logger) With(kv ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &child
+}
+
+func (l *Logger) Level() Level       { return Level(atomic.LoadInt32(l.level)) }
+func (l *Logger) SetLevel(lvl Level) { atomic.StoreInt32(l.level, int32(lvl)) }
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// kv are key, value pairs. Errors are logged as their message.
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if level < l.Level() {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+
+	var buf bytes.Buffer
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	if l.text {
+		fmt.Fprintf(&buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+	} else {
+		buf.WriteString(`{"time":"` + now + `","level":"` + level.String() + `","msg":`)
+		writeJSON(&buf, msg)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var val interface{} = "MISSING"
+		if i+1 < len(fields) {
+			val = fields[i+1]
+		}
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		if l.text {
+			fmt.Fprintf(&buf, " %s=%v", key, val)
+		} else {
+			buf.WriteString(",")
+			writeJSON(&buf, key)
+			buf.WriteString(":")
+			writeJSON(&buf, val)
+		}
+	}
+	if !l.text {
+		buf.WriteString("}")
+	}
+	buf.WriteString("\n")
+
+	l.mu.Lock()
+	l.out.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// Lines of the standard log package and of gin's recovery, e.g. from
+// net/http, become log lines of logger at the given level
+type logWriter struct {
+	log   *Logger
+	level Level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.log.log(w.level, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+type logKey struct{}
+
+func withLog(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, logKey{}, l)
+}
+
+// The logger of a crawl run or request, the global one if ctx has none
+func logFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(logKey{}).(*Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// A random ID for a crawl run or a request
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Gives every request an ID, the X-Request-ID it came with if it has a sane
+// one, and a logger carrying it. Each request is logged once it's done, with
+// the client IP the rate limits go by.
+func (e *Env) requestLogger(c *gin.Context) {
+	id := c.Request.Header.Get("X-Request-ID")
+	if len(id) == 0 || len(id) > 64 || strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) >= 0 {
+		id = newID()
+	}
+	c.Header("X-Request-ID", id)
+	l := logger.With("request_id", id)
+	c.Request = c.Request.WithContext(withLog(c.Request.Context(), l))
+
+	start := time.Now()
+	c.Next()
+
+	// Handlers may have added fields, e.g. authorize adds the API key
+	l = requestLog(c)
+	status := c.Writer.Status()
+	level := LevelInfo
+	if status >= 500 {
+		level = LevelError
+	}
+	l.log(level, "request", []interface{}{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"bytes", c.Writer.Size(),
+		"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		"ip", e.settings().proxies.clientIP(c.Request),
+	})
+}
+
+// The logger of the request
+func requestLog(c *gin.Context) *Logger {
+	return logFrom(c.Request.Context())
+}
+
+// GET /log/level tells the log level, PUT /log/level {"level": "debug"}
+// changes it until the next restart
+func (e *Env) logLevel(c *gin.Context) {
+	if c.Request.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if c.BindJSON(&body) != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Error occurred when parsing your JSON ! X( "})
+			return
+		}
+		level, err := parseLevel(body.Level)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+		if level != logger.Level() {
+			requestLog(c).Info("log level changed", "from", logger.Level().String(), "to", level.String())
+			logger.SetLevel(level)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level().String()})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestLoggerLogsTheClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var out bytes.Buffer
+	old := logger
+	logger = NewLogger(&out, LevelInfo, "json")
+	defer func() { logger = old }()
+
+	trusted, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Env{}
+	e.live.Store(&Settings{proxies: trusted})
+	g := gin.New()
+	g.Use(e.requestLogger)
+	g.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, tt := range []struct {
+		remoteAddr, want string
+	}{
+		{"10.1.2.3:5123", "198.51.100.2"},
+		// Not a proxy, X-Forwarded-For is made up
+		{"203.0.113.7:5123", "203.0.113.7"},
+	} {
+		out.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("X-Forwarded-For", "198.51.100.2")
+		g.ServeHTTP(httptest.NewRecorder(), r)
+
+		var line struct {
+			IP string `json:"ip"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v in %q", tt.remoteAddr, err, out.String())
+		}
+		if line.IP != tt.want {
+			t.Errorf("%s: logged %s, want %s", tt.remoteAddr, line.IP, tt.want)
+		}
+	}
+}
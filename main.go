@@ -1,226 +1,375 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
+	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/asdine/storm"
-	"github.com/asdine/storm/q"
+	"github.com/coreos/bbolt"
 	"github.com/gin-gonic/gin"
 )
 
-// Has to be `type` to return JSON array
-// https://github.com/gin-gonic/gin/issues/87
-type Queries []Query
-type Query struct {
-	Title       string `json:"title,omitempty"`
-	Description string `json:"description,omitempty"`
-	Filename    string `json:"filename,omitempty"`
-	Src         string `json:"src,omitempty"`
-}
-
-// JSON parsing and accessing
-// https://github.com/astaxie/build-web-application-with-golang/blob/master/zh/07.2.md
-type CreativesSlice struct {
-	Creatives []Creative `json:"creatives_to_follow"`
-}
-
-type Creative struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-}
-
-type UserProjectsSlice struct {
-	Projects []UserProject `json:"projects"`
-}
-
-type UserProject struct {
-	ID int `json:"id"`
-}
-
-type Project struct {
-	Project ProjectParsed `json:"project"`
-}
-
-type ProjectParsed struct {
-	Title       string                 `json:"name"`
-	Description string                 `json:"description"`
-	Src         map[string]interface{} `json:"covers"`
-}
-
 type Data struct {
 	ID          int    `storm:"id,increment" json:"id"`
 	Title       string `storm:"index" json:"title"`
 	Description string `json:"description"`
 	Filename    string `storm:"index" json:"filename"`
 	Src         string `storm:"index" json:"src"`
+	// Where the row came from, see Provider
+	Provider   string `storm:"index" json:"provider"`
+	UpstreamID string `storm:"index" json:"upstream_id"`
+	// Provider and UpstreamID together, so ingesting the same project twice
+	// updates the row instead of adding a new one. Empty for old rows.
+	UpstreamKey string    `storm:"unique" json:"upstream_key,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// The downloaded cover, see fetchImages
+	Hash string `storm:"index" json:"hash"`
+	Size int64  `json:"size"`
+	MIME string `json:"mime"`
+	// Edited through the API, crawls keep its title, description and cover
+	Curated bool `json:"curated"`
+	// Owners, tags, stats, ... see Metadata. Empty for rows crawled before
+	// they were kept, until the next crawl fills them in.
+	Metadata
 }
 
 type Env struct {
-	db *storm.DB
+	db        *storm.DB
+	scheduler *Scheduler
+	sweeper   *Sweeper
+	client    *Client
+	store     BlobStore
+	thumbs    *ThumbCache
+	// The last write to the store by /readyz
+	storeCheck cachedCheck
+	// One slot per resize allowed to run at once
+	resizing chan struct{}
+	// Whether serve crawls in the background
+	crawling bool
+	// The *Settings a SIGHUP can change, see reload
+	live atomic.Value
+}
+
+// How long serve waits for requests and the crawl once asked to stop, unless
+// shutdown_timeout says otherwise
+const defaultShutdownTimeout = 30 * time.Second
+
+// Commands of foli, serve when none is given
+var commands = map[string]func(cfg *Config, args []string){
+	"serve":   serveCommand,
+	"crawl":   crawlCommand,
+	"stats":   statsCommand,
+	"migrate": migrateCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+	"keys":    keysCommand,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: foli [-config foli.yaml] [-db foli.db] <command> [flags]
+
+Commands:
+  serve     serve the entries, crawling in the background (default)
+  crawl     crawl once and exit
+  stats     show what foli.db holds
+  migrate   show or change the schema version of foli.db
+  backup    write foli.db and the covers to an archive
+  restore   read an archive of backup back
+  export    write the entries as JSON Lines or CSV
+  import    read entries written by export
+  keys      create, list or revoke API keys
+
+Run foli <command> -h for the flags of a command.
+Global flags:`)
+	flag.PrintDefaults()
 }
 
 func main() {
-	var api = ensureEnv("API")
+	configPath := flag.String("config", "", "YAML config file, by default $FOLI_CONFIG or ./foli.yaml if it exists")
+	db := flag.String("db", "", "database file, overrides the config")
+	flag.Usage = usage
+	flag.Parse()
+
+	// Secrets are masked in anything logged
+	log.SetOutput(logWriter{logger, LevelError})
+	gin.DefaultWriter = redactingWriter{os.Stdout}
+	gin.DefaultErrorWriter = redactingWriter{os.Stderr}
 
-	db, err := storm.Open(filepath.Join(".", "foli.db"))
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("%s\n", err)
 	}
-	defer db.Close()
-	// Initialize buckets and indexes before saving an object
-	db.Init(&Data{})
-
-	fetchItem(api, db)
-	fmt.Println("Done! Now you may access the server via localhost:8080")
-
-	g := gin.Default()
-	env := &Env{db: db}
-
-	g.GET("/", env.queryAll)
-	g.POST("/q", env.queryJSON)
-	g.Static("/imgs", "./images")
-	g.Run() // default localhost:8080
-}
+	if *db != "" {
+		cfg.DB = *db
+	}
 
-func ensureEnv(key string) string {
-	val, ok := os.LookupEnv(key)
+	name, args := "serve", flag.Args()
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	command, ok := commands[name]
 	if !ok {
-		// Early returning, return 1 to end this process
-		// https://stackoverflow.com/questions/33885235/should-a-go-package-ever-use-log-fatal-and-when
-		log.Fatalf("%s not set, exiting ...\nShould provide the Behance api key or client id in order to query images.", key)
-	} else {
-		fmt.Printf("Using \"%s\" as API key / client ID...\n\n", val)
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+		usage()
+		os.Exit(2)
 	}
-	return val
-}
-
-// Dump all the entries in DB
-func (e *Env) queryAll(c *gin.Context) {
-	var respJSON []Data
-	e.db.All(&respJSON)
-	c.JSON(http.StatusOK, respJSON)
+	if err := cfg.validate(false); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	level, _ := parseLevel(cfg.Log.Level)
+	logger = NewLogger(redactingWriter{os.Stderr}, level, cfg.Log.Format)
+	log.SetOutput(logWriter{logger, LevelError})
+	imageDir = cfg.Images.Dir
+	maxImageSize = int64(cfg.Images.MaxSizeMB) << 20
+	command(cfg, args)
 }
 
-// Query the entries in DB based on the user input JSON request
-func (e *Env) queryJSON(c *gin.Context) {
-	var userQueries Queries
+// foli serve [-listen addrs] [-crawl=false]
+func serveCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", cfg.Listen, "addresses to listen on, separated by commas, unix:/path for a Unix socket")
+	crawl := flags.Bool("crawl", cfg.Crawl.Interval > 0, "crawl in the background every crawl.interval")
+	flags.Parse(args)
+	cfg.Listen = *listen
+	if err := cfg.validate(*crawl); err != nil {
+		log.Fatalf("%s\n", err)
+	}
 
-	// Parsing JSON, early return if error occurred
-	if c.BindJSON(&userQueries) != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"message": "Error occurred when parsing your JSON query ! X( "})
-		return
+	db := openDB(cfg)
+	// Initialize buckets and indexes, and bring rows stored by older
+	// versions up to date, before saving an object
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := ensureSearchIndex(db); err != nil {
+		log.Fatalf("%s\n", err)
 	}
 
-	results := make([]Data, len(userQueries))
-	for i, userQuery := range userQueries {
-		// Passing slice to a variadic function, learned
-		// https://blog.learngoprogramming.com/golang-variadic-funcs-how-to-patterns-369408f19085
-		var query []q.Matcher
+	client := NewClient(cfg.HTTP.Timeout, cfg.HTTP.Retries)
+	store := newBlobStore(cfg)
+	var provider Provider
+	if *crawl {
+		provider = newProvider(cfg, client)
+	}
+	crawler := &Crawler{
+		provider: provider,
+		db:       db,
+		client:   client,
+		store:    store,
+		workers:  cfg.Crawl.Workers,
+		pages:    cfg.Crawl.Pages,
+	}
 
-		if userQuery.Title != "" {
-			query = append(query, q.Eq("Title", userQuery.Title))
+	// Listen before crawling, so a port in use doesn't leave a crawl behind
+	var listeners []net.Listener
+	// validate made sure it parses
+	socketMode, _ := parseSocketMode(cfg.SocketMode)
+	for _, addr := range listenAddrs(cfg.Listen) {
+		ln, err := listenOn(addr, socketMode)
+		if err != nil {
+			log.Fatalf("%s\n", err)
 		}
-		if userQuery.Description != "" {
-			query = append(query, q.Eq("Description", userQuery.Description))
+		listeners = append(listeners, ln)
+	}
+	var certs *CertReloader
+	if cfg.TLS.Enabled() {
+		var err error
+		certs, err = NewCertReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+	}
+
+	// Serve what is already in foli.db right away, the crawl runs behind
+	scheduler := NewScheduler(crawler, cfg.Crawl.Interval)
+	if *crawl {
+		scheduler.Start(context.Background())
+	}
+	// Covers no entry uses are deleted a while after, see sweepCovers
+	sweeper := NewSweeper(db, store)
+	sweeper.Start()
+
+	thumbs, err := NewThumbCache(cfg.Thumbs.Dir, int64(cfg.Thumbs.SizeMB)<<20)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	env := &Env{
+		db:        db,
+		scheduler: scheduler,
+		sweeper:   sweeper,
+		client:    client,
+		store:     store,
+		thumbs:    thumbs,
+		resizing:  make(chan struct{}, runtime.NumCPU()),
+		crawling:  *crawl,
+	}
+	env.live.Store(newSettings(cfg, nil))
+	g := gin.New()
+	g.Use(env.requestLogger, httpMetrics(g), compress, gin.RecoveryWithWriter(logWriter{logger, LevelError}))
+	if !cfg.Auth.Enabled {
+		logger.Warn("Authentication is off, anyone who can reach foli can change the entries and download foli.db")
+	} else if n, err := db.Count(&APIKey{}); err == nil && n == 0 {
+		logger.Warn("There are no API keys, every request will be refused until one is made with foli keys create")
+	}
+
+	// Probes don't need a key
+	g.GET("/healthz", env.healthz)
+	g.GET("/readyz", env.readyz)
+
+	read := g.Group("/", env.rateLimitIP, env.authorize(scopeRead), env.rateLimitKey)
+	// Made from the entries, so they can be cached until those change
+	read.GET("/", env.conditional, env.cached, env.queryAll)
+	read.POST("/q", env.conditional, env.cached, env.queryJSON)
+	read.GET("/search", env.conditional, env.cached, env.searchJSON)
+	read.GET("/sync", env.syncStatus)
+	read.GET("/metrics", env.metrics)
+	read.GET("/log/level", env.logLevel)
+	read.GET("/imgs/:name", env.serveImage)
+	read.HEAD("/imgs/:name", env.serveImage)
+	read.GET("/api/v1/items/:id", env.conditional, env.getItem)
+
+	write := g.Group("/", env.rateLimitIP, env.authorize(scopeWrite), env.rateLimitKey)
+	write.GET("/backup", env.backup)
+	write.PUT("/log/level", env.logLevel)
+	write.POST("/api/v1/items", env.createItem)
+	write.PUT("/api/v1/items/:id", env.replaceItem)
+	write.PATCH("/api/v1/items/:id", env.patchItem)
+	write.DELETE("/api/v1/items/:id", env.deleteItem)
+
+	srv := &http.Server{Handler: g}
+	if certs != nil {
+		srv.TLSConfig = certs.ServerConfig()
+		if !cfg.TLS.HTTP2 {
+			// An empty map keeps net/http from setting up HTTP/2
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 		}
-		if userQuery.Filename != "" {
-			query = append(query, q.Eq("Filename", userQuery.Filename))
+		if cfg.TLS.ReloadInterval > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go certs.Watch(cfg.TLS.ReloadInterval, stop)
 		}
-		if userQuery.Src != "" {
-			query = append(query, q.Eq("Src", userQuery.Src))
+	}
+	failed := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			// Unix sockets stay plain HTTP, who may connect is up to the
+			// permissions of the socket
+			if certs != nil && ln.Addr().Network() == "tcp" {
+				failed <- srv.ServeTLS(ln, "", "")
+			} else {
+				failed <- srv.Serve(ln)
+			}
+		}(ln)
+	}
+	logger.Info("Now you may access the server", "listen", cfg.Listen, "tls", certs != nil, "crawling", *crawl)
+
+	// SIGHUP reloads the config, SIGINT and SIGTERM stop foli
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-failed:
+			scheduler.Stop()
+			sweeper.Stop()
+			db.Close()
+			log.Fatalf("%s\n", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				cfg = env.reload(cfg)
+				if certs != nil {
+					certs.Reload()
+				}
+				continue
+			}
+			env.shutdown(srv, cfg.ShutdownTimeout, sig)
+			return
 		}
-		var resp Data
-		e.db.Select(query...).First(&resp)
-		results[i] = resp
 	}
+}
 
-	c.JSON(http.StatusOK, results)
+// Stops the crawl, lets the requests being served finish and closes foli.db,
+// giving up on whatever isn't done after timeout
+func (e *Env) shutdown(srv *http.Server, timeout time.Duration, sig os.Signal) {
+	logger.Info("Stopping", "signal", sig.String(), "timeout", timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Downloads stop right away, what was downloaded is still saved
+	e.scheduler.Stop()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("Requests were still running", "error", err)
+	}
+	if err := e.scheduler.Wait(ctx); err != nil {
+		logger.Warn("The crawl was still saving", "error", err)
+	}
+	e.sweeper.Stop()
+	if err := e.db.Close(); err != nil {
+		logger.Error("Closing the database failed", "error", err)
+	}
+	logger.Info("Stopped")
 }
 
-// Use endpoint /v2/creativestofollow to fetch a list of creatives to follow (user).
-// Use endpoint /v2/users/:username to fetch a list of projects created by user.
-// Use endpoint /v2/projects/:id to fetch the cover and description needed.
-// And, it accepts a parameter to do pagination.
-// https://www.behance.net/dev/api/endpoints/9
-func fetchItem(apiKey string, db *storm.DB) {
-	fetch := func(url string, page int, dest interface{}) error {
-		urlWithPage := fmt.Sprintf("%s?page=%d&client_id=%s", url, page, apiKey)
-		response, err := http.Get(urlWithPage)
+// The Behance provider is used unless fixture points to a local fixture file
+func newProvider(cfg *Config, client *Client) Provider {
+	if cfg.Fixture != "" {
+		fixture, err := NewFixture(cfg.Fixture)
 		if err != nil {
-			log.Printf("%s\n", err)
-			return err
-		}
-		defer response.Body.Close() // resource management
-		json.NewDecoder(response.Body).Decode(dest)
-		return nil
-	}
-
-	var userList CreativesSlice
-	var projectList UserProjectsSlice
-	var resource Project
-	for i := 0; i < 10; i++ {
-		fetch("https://api.behance.net/v2/creativestofollow", 1+i, &userList)
-		for j, creative := range userList.Creatives {
-			fetch(fmt.Sprintf("https://api.behance.net/v2/users/%s/projects", creative.Username), 1, &projectList)
-			fetch(fmt.Sprintf("https://api.behance.net/v2/projects/%d", projectList.Projects[0].ID), 1, &resource)
-
-			data := Data{
-				Title:       resource.Project.Title,
-				Description: resource.Project.Description,
-				Filename:    getFilename(resource.Project.Src["original"].(string)),
-				Src:         resource.Project.Src["original"].(string),
-			}
-
-			fmt.Printf("Fetching and populating...  %d / 100\n", i*10+j)
-			go fetchImages(data.Src)
-			go db.Save(&data)
+			log.Fatalf("%s\n", err)
 		}
+		return fixture
 	}
+	logger.Info("Using Behance", "api_key", maskSecret(cfg.API))
+	return NewBehance(cfg.API, client)
 }
 
-func fetchImages(src string) error {
-	client := http.Client{
-		Transport: &http.Transport{
-			Dial: func(network, addr string) (net.Conn, error) {
-				return net.DialTimeout(network, addr, 3*time.Second)
-			},
-		},
+// Images are kept in images.dir unless images.store is s3, in which case they
+// go to the bucket s3.bucket of the S3 compatible service at s3.endpoint.
+func newBlobStore(cfg *Config) BlobStore {
+	switch cfg.Images.Store {
+	case "s3":
+		s3 := cfg.S3
+		store, err := NewS3Store(s3.Endpoint, s3.Bucket, s3.Region, s3.AccessKey, s3.SecretKey)
+		if err != nil {
+			log.Fatalf("%s\n", err)
+		}
+		return store
+	default:
+		return NewLocalStore(cfg.Images.Dir)
 	}
+}
 
-	resp, err := client.Get(src)
-	if err != nil {
-		return err
+// Opens foli.db for a command. Only one process can have it open, commands
+// which change it have to wait for the server to stop.
+func openDB(cfg *Config) *storm.DB {
+	db, err := storm.Open(cfg.DB)
+	if err == bolt.ErrTimeout {
+		log.Fatalf("%s is in use, stop foli first\n", cfg.DB)
 	}
-	defer resp.Body.Close()
-
-	b, err := ioutil.ReadAll(resp.Body) // reads until EOF, for byte[]
 	if err != nil {
-		return err
+		log.Fatalf("%s\n", err)
 	}
-
-	// Path setup
-	path := filepath.Join(".", "images")
-	os.MkdirAll(path, os.ModePerm)
-
-	filename := getFilename(src)
-	// saves to fs
-	ioutil.WriteFile(filepath.Join(path, filename), b, 0644)
-	return nil
+	return db
 }
 
-func getFilename(src string) string {
-	url := strings.Split(src, "/")
-	if len(url) < 1 {
-		log.Fatalf("invalid url %s\n", src)
-	}
-	return url[len(url)-1]
+// Report how the background sync is doing
+func (e *Env) syncStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, e.scheduler.Status())
 }
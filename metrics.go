@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Counters and histograms served by GET /metrics in the Prometheus text
+// format. The DB gauges are read when scraped, see (e *Env) metrics.
+var (
+	crawlRuns = newCounter("foli_crawl_runs_total",
+		"Crawls run, by provider and result (done, stopped or interrupted)", "provider", "result")
+	crawlDuration = newHistogram("foli_crawl_duration_seconds",
+		"How long crawls took", []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}, "provider")
+	crawlProjects = newCounter("foli_crawl_projects_fetched_total",
+		"Projects whose cover was resolved by crawls", "provider")
+	crawlSaved = newCounter("foli_crawl_items_saved_total",
+		"Entries saved by crawls", "provider")
+	crawlFailed = newCounter("foli_crawl_items_failed_total",
+		"Creators or covers crawls couldn't fetch, download or save", "provider")
+
+	upstreamRequests = newCounter("foli_upstream_requests_total",
+		"Requests sent upstream, by endpoint and status code, error when there was no response", "endpoint", "code")
+	upstreamDuration = newHistogram("foli_upstream_request_duration_seconds",
+		"How long upstream took to answer, retries are separate requests", defaultBuckets, "endpoint")
+	downloadBytes = newCounter("foli_download_bytes_total",
+		"Bytes of covers downloaded")
+	downloadErrors = newCounter("foli_download_errors_total",
+		"Covers that couldn't be downloaded or stored")
+
+	httpRequests = newCounter("foli_http_requests_total",
+		"Requests served, by method, route and status code", "method", "route", "code")
+	httpDuration = newHistogram("foli_http_request_duration_seconds",
+		"How long requests took to serve", defaultBuckets, "method", "route")
+	httpCache = newCounter("foli_http_cache_total",
+		"Lookups in the response cache, by result (hit or miss)", "result")
+	httpRejected = newCounter("foli_http_rejected_total",
+		"Requests refused by the limits, by reason (rate_limit, too_many_queries or limit_too_large)", "reason")
+)
+
+// The buckets of the Prometheus client libraries, in seconds
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Every metric, in the order they are declared
+var registry []metric
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// A set of series of one metric, keyed by their label values
+type series struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("%s has labels %v, got %d values", s.name, s.labels, len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := s.values[key]; !ok {
+		s.values[key] = append([]string{}, values...)
+	}
+	return key
+}
+
+// Keys of the series sorted, so scrapes are stable
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *series) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+}
+
+// Counter only goes up
+type Counter struct {
+	series
+	counts map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: series{name: name, help: help, kind: "counter", labels: labels, values: make(map[string][]string)},
+		counts: make(map[string]float64),
+	}
+	registry = append(registry, c)
+	return c
+}
+
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+func (c *Counter) Add(v float64, labels ...string) {
+	c.mu.Lock()
+	c.counts[c.key(labels)] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w)
+	if len(c.labels) == 0 && len(c.counts) == 0 {
+		// Shows up as 0 before anything happened
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, c.values[key]), formatFloat(c.counts[key]))
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	series
+	buckets []float64
+	data    map[string]*histogramData
+}
+
+type histogramData struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		series:  series{name: name, help: help, kind: "histogram", labels: labels, values: make(map[string][]string)},
+		buckets: buckets,
+		data:    make(map[string]*histogramData),
+	}
+	registry = append(registry, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labels)
+	d, ok := h.data[key]
+	if !ok {
+		d = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.data[key] = d
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		d.counts[i]++
+	}
+	d.count++
+	d.sum += v
+}
+
+func (h *Histogram) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w)
+	for _, key := range h.sortedKeys() {
+		values, d := h.values[key], h.data[key]
+		le := append(append([]string{}, h.labels...), "le")
+		bucket := func(bound string) string {
+			return labelPairs(le, append(append([]string{}, values...), bound))
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += d.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket(formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket("+Inf"), d.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, values), formatFloat(d.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, values), d.count)
+	}
+}
+
+// {a="1",b="2"}, nothing when there are no labels
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// Counts and times the requests by route. gin doesn't tell which route
+// matched, so the routes are looked up by method and handler once they are
+// all registered, requests that matched none are counted as unmatched.
+func httpMetrics(g *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	routes := make(map[string]string)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		once.Do(func() {
+			for _, r := range g.Routes() {
+				routes[r.Method+" "+r.Handler] = r.Path
+			}
+		})
+		route, ok := routes[c.Request.Method+" "+c.HandlerName()]
+		if !ok {
+			route = "unmatched"
+		}
+		httpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		httpDuration.ObserveSince(start, c.Request.Method, route)
+	}
+}
+
+// GET /metrics, in the Prometheus text format
+func (e *Env) metrics(c *gin.Context) {
+	var buf bytes.Buffer
+	for _, m := range registry {
+		m.write(&buf)
+	}
+
+	// Goes through every entry, which is fine at the size of foli.db and
+	// the usual scrape intervals
+	stats, err := collectStats(e.db)
+	if err != nil {
+		requestLog(c).Error("Can't read foli.db for the metrics", "error", err)
+	} else {
+		writeGauge(&buf, "foli_db_entries", "Entries in foli.db", float64(stats.Entries))
+		writeGauge(&buf, "foli_db_size_bytes", "Size of the foli.db file", float64(stats.DBBytes))
+		writeGauge(&buf, "foli_images", "Distinct covers in the image store", float64(stats.Covers))
+		writeGauge(&buf, "foli_images_size_bytes", "Bytes the distinct covers take in the image store", float64(stats.CoverBytes))
+	}
+	running := 0.0
+	if e.scheduler.Running() {
+		running = 1
+	}
+	writeGauge(&buf, "foli_crawl_running", "1 while a background crawl runs", running)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// Migration moves foli.db from Version-1 to Version. Add a new one at the
+// end of migrations whenever the rows or indexes of Data change, e.g. a new
+// indexed field needs tx.ReIndex(&Data{}).
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx storm.Node) error
+	// Undoes Up, nil when it can't be undone
+	Down func(tx storm.Node) error
+}
+
+var migrations = []Migration{
+	{1, "Create the buckets and indexes of entries", migrateInit, nil},
+	{2, "Keep project metadata and every cover size in rows", migrateMetadata, unmigrateMetadata},
+	{3, "Create the bucket and indexes of API keys", migrateAPIKeys, unmigrateAPIKeys},
+}
+
+// The migrations bucket has the time each applied migration ran at, by
+// version. The current version is kept in the meta bucket.
+const (
+	metaBucket       = "meta"
+	migrationsBucket = "migrations"
+	schemaVersionKey = "schema_version"
+)
+
+// Stops a dry run from being committed
+var errDryRun = errors.New("dry run")
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// The version foli.db is at. Databases made before versions were kept are at
+// 0, creating buckets and indexes again is harmless for them.
+func schemaVersion(db storm.Node) (int, error) {
+	var version int
+	err := db.Get(metaBucket, schemaVersionKey, &version)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Applies or rolls back migrations until foli.db is at version target, all in
+// one bbolt transaction, so it either gets there or stays where it was. A dry
+// run does the same and rolls the transaction back at the end.
+func migrate(db *storm.DB, target int, dryRun bool) error {
+	if target < 0 || target > latestSchemaVersion() {
+		return fmt.Errorf("there's no version %d, the latest is %d", target, latestSchemaVersion())
+	}
+
+	err := db.Bolt.Update(func(btx *bolt.Tx) error {
+		tx := db.WithTransaction(btx)
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > latestSchemaVersion() {
+			return fmt.Errorf("foli.db is at version %d, made by a newer foli than this one (%d)", version, latestSchemaVersion())
+		}
+		if version == target {
+			return nil
+		}
+
+		for version < target {
+			m := migrations[version]
+			logger.Info("Migrating foli.db up", "version", m.Version, "migration", m.Description)
+			if err := m.Up(tx); err != nil {
+				return fmt.Errorf("migration %d: %s", m.Version, err)
+			}
+			if err := tx.Set(migrationsBucket, m.Version, time.Now()); err != nil {
+				return err
+			}
+			version = m.Version
+		}
+		for version > target {
+			m := migrations[version-1]
+			if m.Down == nil {
+				return fmt.Errorf("migration %d (%s) can't be rolled back", m.Version, m.Description)
+			}
+			logger.Info("Migrating foli.db down", "from_version", m.Version, "migration", m.Description)
+			if err := m.Down(tx); err != nil {
+				return fmt.Errorf("rolling back migration %d: %s", m.Version, err)
+			}
+			if err := tx.Delete(migrationsBucket, m.Version); err != nil && err != storm.ErrNotFound {
+				return err
+			}
+			version = m.Version - 1
+		}
+
+		if err := tx.Set(metaBucket, schemaVersionKey, version); err != nil {
+			return err
+		}
+		// Migrations may change how entries look
+		if err := bumpChanges(tx); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		fmt.Println("Dry run, nothing was changed")
+		return nil
+	}
+	return err
+}
+
+// foli migrate status|up|down [-to version] [-dry-run]
+func migrateCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", -1, "version to migrate to, by default the latest for up and the previous one for down")
+	dryRun := flags.Bool("dry-run", false, "run the migrations then roll them back")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: foli migrate status|up|down [-to version] [-dry-run]")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+
+	db := openDB(cfg)
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	switch command {
+	case "status":
+		fmt.Printf("%s is at version %d, the latest is %d\n", cfg.DB, version, latestSchemaVersion())
+		for _, m := range migrations {
+			state := "pending"
+			var at time.Time
+			if db.Get(migrationsBucket, m.Version, &at) == nil {
+				state = "applied " + at.Format(time.RFC3339)
+			} else if m.Version <= version {
+				state = "applied"
+			}
+			fmt.Printf("%4d  %-36s %s\n", m.Version, state, m.Description)
+		}
+		return
+	case "up":
+		if *to < 0 {
+			*to = latestSchemaVersion()
+		}
+		if *to < version {
+			log.Fatalf("%s is at version %d already, use down to go back to %d\n", cfg.DB, version, *to)
+		}
+	case "down":
+		if *to < 0 {
+			*to = version - 1
+		}
+		if *to > version {
+			log.Fatalf("%s is at version %d, use up to go to %d\n", cfg.DB, version, *to)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := migrate(db, *to, *dryRun); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if !*dryRun {
+		fmt.Printf("%s is at version %d\n", cfg.DB, *to)
+	}
+}
+
+// Version 1 is what db.Init(&Data{}) used to do on every startup
+func migrateInit(tx storm.Node) error {
+	return tx.Init(&Data{})
+}
+
+// Version 2 keeps every size of the cover and the project metadata. Rows
+// from before only have Src, which is the original size, the rest is filled
+// in when the project is crawled again.
+func migrateMetadata(tx storm.Node) error {
+	var rows []Data
+	if err := tx.All(&rows); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Src == "" || len(row.Covers) > 0 {
+			continue
+		}
+		row.Covers = map[string]string{"original": row.Src}
+		if err := tx.Save(&row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drops the metadata version 1 doesn't know about
+func unmigrateMetadata(tx storm.Node) error {
+	var rows []Data
+	if err := tx.All(&rows); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		row.Metadata = Metadata{}
+		if err := tx.Save(&row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Version 3 adds the API keys
+func migrateAPIKeys(tx storm.Node) error {
+	return tx.Init(&APIKey{})
+}
+
+// Revokes every key, they can't be checked by older versions anyway
+func unmigrateAPIKeys(tx storm.Node) error {
+	return tx.Drop(&APIKey{})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+// A foli.db made before versions were kept, with one legacy row
+func newLegacyDB(t *testing.T) *storm.DB {
+	db, err := storm.Open(filepath.Join(t.TempDir(), "foli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Save(&Data{Title: "Old", Src: "http://example.com/1.png", Filename: "1.png"}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// The version of db, and the migrations recorded as applied
+func migrationState(t *testing.T, db *storm.DB) (int, []int) {
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied []int
+	for _, m := range migrations {
+		var at time.Time
+		if db.Get(migrationsBucket, m.Version, &at) == nil {
+			applied = append(applied, m.Version)
+		}
+	}
+	return version, applied
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db := newLegacyDB(t)
+	if version, applied := migrationState(t, db); version != 0 || len(applied) != 0 {
+		t.Fatalf("a legacy foli.db is at %d with %v applied, want 0 and none", version, applied)
+	}
+
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		t.Fatal(err)
+	}
+	version, applied := migrationState(t, db)
+	if version != latestSchemaVersion() || len(applied) != len(migrations) {
+		t.Errorf("up: at %d with %v applied, want %d with all of them", version, applied, latestSchemaVersion())
+	}
+	var row Data
+	if err := db.One("Title", "Old", &row); err != nil || row.Covers["original"] != row.Src {
+		t.Errorf("legacy row = %+v, %v, want its src as the original cover", row, err)
+	}
+	if _, _, err := createAPIKey(db, "ci", scopeRead); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating to where it is already is a no-op
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if version, applied := migrationState(t, db); version != 1 || len(applied) != 1 || applied[0] != 1 {
+		t.Errorf("down: at %d with %v applied, want 1 with [1]", version, applied)
+	}
+	if err := db.One("Title", "Old", &row); err != nil || row.Covers != nil {
+		t.Errorf("legacy row after down = %+v, %v, want its metadata dropped", row, err)
+	}
+	if n, err := db.Count(&APIKey{}); err == nil && n != 0 {
+		t.Errorf("%d API keys left after rolling them back", n)
+	}
+
+	// Version 1 can't be rolled back, and nothing changes when it fails
+	if err := migrate(db, 0, false); err == nil {
+		t.Error("rolled back migration 1")
+	}
+	if version, _ := migrationState(t, db); version != 1 {
+		t.Errorf("at %d after a failed rollback, want 1", version)
+	}
+	for _, target := range []int{-1, latestSchemaVersion() + 1} {
+		if err := migrate(db, target, false); err == nil {
+			t.Errorf("migrated to %d", target)
+		}
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db := newLegacyDB(t)
+	before, err := loadChanges(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, latestSchemaVersion(), true); err != nil {
+		t.Fatal(err)
+	}
+	if version, applied := migrationState(t, db); version != 0 || len(applied) != 0 {
+		t.Errorf("after a dry run at %d with %v applied, want 0 and none", version, applied)
+	}
+	var row Data
+	if err := db.One("ID", 1, &row); err != nil || len(row.Covers) != 0 {
+		t.Errorf("legacy row = %+v, %v, want it untouched", row, err)
+	}
+	if after, err := loadChanges(db); err != nil || after != before {
+		t.Errorf("changes = %+v, %v, want %+v", after, err, before)
+	}
+}
+
+func TestMigrateRefusesNewerDB(t *testing.T) {
+	db := newLegacyDB(t)
+	if err := db.Set(metaBucket, schemaVersionKey, latestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, latestSchemaVersion(), false); err == nil {
+		t.Error("migrated a foli.db made by a newer foli")
+	}
+}
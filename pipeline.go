@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/asdine/storm"
+)
+
+// How many downloads run at once, unless crawl.workers says otherwise
+const defaultWorkers = 4
+
+// Pipeline downloads the covers and then saves them to the DB. Downloads run
+// on a fixed number of workers, the DB writes go through a single saver since
+// bbolt only allows one writer at a time anyway. Submit blocks once the queue
+// is full, so a big crawl can't open more connections or files than that.
+type Pipeline struct {
+	// Of the crawl run, for the downloads and the logs
+	ctx       context.Context
+	log       *Logger
+	db        *storm.DB
+	client    *Client
+	store     BlobStore
+	downloads chan Data
+	saves     chan Data
+
+	workers sync.WaitGroup
+	saver   sync.WaitGroup
+	// Jobs submitted but not done yet, see Wait
+	pending sync.WaitGroup
+
+	mu     sync.Mutex
+	saved  int
+	errors []error
+}
+
+func NewPipeline(ctx context.Context, db *storm.DB, client *Client, store BlobStore, workers int) *Pipeline {
+	if workers < 1 {
+		workers = defaultWorkers
+	}
+	p := &Pipeline{
+		ctx:       ctx,
+		log:       logFrom(ctx),
+		db:        db,
+		client:    client,
+		store:     store,
+		downloads: make(chan Data, workers),
+		saves:     make(chan Data, workers),
+	}
+
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.download()
+	}
+	p.saver.Add(1)
+	go p.save()
+	return p
+}
+
+// Queues data to have its cover downloaded and then be saved
+func (p *Pipeline) Submit(data Data) {
+	p.pending.Add(1)
+	p.downloads <- data
+}
+
+// Waits for everything submitted so far to be saved or to fail
+func (p *Pipeline) Wait() {
+	p.pending.Wait()
+}
+
+// Drains the queues and stops the workers. It returns how many items were
+// saved and the errors of the ones that failed.
+func (p *Pipeline) Close() (int, []error) {
+	close(p.downloads)
+	p.workers.Wait()
+	close(p.saves)
+	p.saver.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saved, p.errors
+}
+
+func (p *Pipeline) download() {
+	defer p.workers.Done()
+	for data := range p.downloads {
+		// No cover, no entry. The next crawl will try again.
+		info, err := fetchImages(p.ctx, p.db, p.client, p.store, data.Src)
+		if err != nil && p.ctx.Err() != nil {
+			// The crawl was interrupted, it isn't the cover's fault. The
+			// page is done again on the next crawl.
+			p.pending.Done()
+			continue
+		}
+		if err != nil {
+			p.fail(data, err)
+			continue
+		}
+		data.Hash, data.Size, data.MIME = info.Hash, info.Size, info.MIME
+		p.saves <- data
+	}
+}
+
+func (p *Pipeline) save() {
+	defer p.saver.Done()
+	for data := range p.saves {
+		if err := upsert(p.db, &data); err != nil {
+			p.fail(data, err)
+			continue
+		}
+		p.log.Debug("Saved", "id", data.ID, "upstream_id", data.UpstreamID, "hash", data.Hash)
+		p.mu.Lock()
+		p.saved++
+		p.mu.Unlock()
+		p.pending.Done()
+	}
+}
+
+func (p *Pipeline) fail(data Data, err error) {
+	p.log.Error("Saving cover failed", "upstream_id", data.UpstreamID, "src", redactURL(data.Src), "error", err)
+	err = fmt.Errorf("%s: %s", redactURL(data.Src), err)
+	p.mu.Lock()
+	p.errors = append(p.errors, err)
+	p.mu.Unlock()
+	p.pending.Done()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Provider is a source of images, e.g. Behance. The ingest loop in fetchItem
+// only talks to this interface, so adding a new source doesn't mean forking it.
+// ctx carries the logger of the crawl run.
+type Provider interface {
+	// Name identifies the provider, it is stored along every Data row.
+	Name() string
+	// ListCreators returns one page of creators to follow, pages start at 1.
+	ListCreators(ctx context.Context, page int) ([]Creator, error)
+	// ListProjects returns the upstream IDs of the projects made by creator.
+	ListProjects(ctx context.Context, creator Creator) ([]string, error)
+	// ResolveCover fetches the title, description and cover of a project.
+	ResolveCover(ctx context.Context, projectID string) (Cover, error)
+}
+
+// Creator is a user of the upstream source whose projects we want.
+type Creator struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// Cover is a single project resolved by a Provider.
+type Cover struct {
+	ProjectID   string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Src         string `json:"src"`
+	Metadata
+}
+
+// Metadata is what a Provider knows about a project besides its cover. It is
+// stored as is along every Data row, providers leave out what they don't have.
+type Metadata struct {
+	Owners []Owner  `json:"owners"`
+	Tags   []string `json:"tags"`
+	// Creative fields, e.g. "Graphic Design"
+	Fields      []string  `json:"fields"`
+	PublishedAt time.Time `json:"published_at"`
+	ModifiedAt  time.Time `json:"modified_at"`
+	// Counts upstream had at the last crawl
+	Views         int `json:"views"`
+	Appreciations int `json:"appreciations"`
+	Comments      int `json:"comments"`
+	// URL of every size of the cover, by width or "original". Src is one of them.
+	Covers map[string]string `json:"covers"`
+}
+
+// Owner is one of the creators of a project
+type Owner struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
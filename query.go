@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/gin-gonic/gin"
+)
+
+// Has to be `type` to return JSON array
+// https://github.com/gin-gonic/gin/issues/87
+type Queries []Query
+
+// Query is one query of POST /q, a Filter plus how to page and sort what
+// matches it.
+type Query struct {
+	Filter
+	Limit   int    `json:"limit,omitempty"`
+	Skip    int    `json:"skip,omitempty"`
+	OrderBy string `json:"orderBy,omitempty"`
+	Reverse bool   `json:"reverse,omitempty"`
+}
+
+// Filter selects entries. Everything in it has to match, i.e. the fields,
+// the conditions of Where, each filter of And and at least one filter of Or.
+type Filter struct {
+	// Shorthands for {"where": {"title": {"eq": ...}}}
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Src         string `json:"src,omitempty"`
+
+	// Conditions by field name, e.g. {"id": {"gt": 10}}
+	Where map[string]Condition `json:"where,omitempty"`
+	And   []Filter             `json:"and,omitempty"`
+	Or    []Filter             `json:"or,omitempty"`
+}
+
+// Condition on a single field, all the operators given have to match
+type Condition struct {
+	Eq     interface{}   `json:"eq,omitempty"`
+	Ne     interface{}   `json:"ne,omitempty"`
+	In     []interface{} `json:"in,omitempty"`
+	Re     string        `json:"re,omitempty"`
+	Prefix string        `json:"prefix,omitempty"`
+	Gt     interface{}   `json:"gt,omitempty"`
+	Gte    interface{}   `json:"gte,omitempty"`
+	Lt     interface{}   `json:"lt,omitempty"`
+	Lte    interface{}   `json:"lte,omitempty"`
+}
+
+// How a queryable field is compared
+const (
+	stringField = iota
+	numberField
+	timeField
+	// A list of strings, operators match if any element does
+	listField
+)
+
+type queryField struct {
+	name string // of the Data struct
+	kind int
+}
+
+// Fields of Data that can be queried or sorted on, by their JSON name
+var queryFields = map[string]queryField{
+	"id":          {"ID", numberField},
+	"title":       {"Title", stringField},
+	"description": {"Description", stringField},
+	"filename":    {"Filename", stringField},
+	"src":         {"Src", stringField},
+	"provider":    {"Provider", stringField},
+	"upstream_id": {"UpstreamID", stringField},
+	"hash":        {"Hash", stringField},
+	"mime":        {"MIME", stringField},
+	"size":        {"Size", numberField},
+	"created_at":  {"CreatedAt", timeField},
+	"updated_at":  {"UpdatedAt", timeField},
+
+	// See Metadata, owners are matched by username
+	"owners":        {"Owners", listField},
+	"tags":          {"Tags", listField},
+	"fields":        {"Fields", listField},
+	"published_at":  {"PublishedAt", timeField},
+	"modified_at":   {"ModifiedAt", timeField},
+	"views":         {"Views", numberField},
+	"appreciations": {"Appreciations", numberField},
+	"comments":      {"Comments", numberField},
+}
+
+// Result of one query, in the same order as the queries
+type QueryResult struct {
+	// How many entries match, regardless of limit and skip
+	Total   int    `json:"total"`
+	Matches []Data `json:"matches"`
+	Message string `json:"message,omitempty"`
+}
+
+func queryFieldNames() string {
+	names := make([]string, 0, len(queryFields))
+	for name := range queryFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Turns JSON values into what the field holds, numbers stay float64 since
+// storm compares across numeric types, times are parsed from RFC 3339.
+func fieldValue(field string, f queryField, v interface{}) (interface{}, error) {
+	switch f.kind {
+	case numberField:
+		if _, ok := v.(float64); !ok {
+			return nil, fmt.Errorf("%s takes numbers, got %v", field, v)
+		}
+	case stringField, listField:
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("%s takes strings, got %v", field, v)
+		}
+	case timeField:
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s takes RFC 3339 times, got %v", field, v)
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s takes RFC 3339 times like 2018-06-01T10:00:00Z, got %s", field, s)
+		}
+		return t, nil
+	}
+	return v, nil
+}
+
+func (cond Condition) matchers(field string) ([]q.Matcher, error) {
+	f, ok := queryFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s, use one of %s", field, queryFieldNames())
+	}
+	if f.kind == listField {
+		return cond.listMatchers(field, f)
+	}
+
+	var matchers []q.Matcher
+	compare := func(v interface{}, fn func(string, interface{}) q.Matcher) error {
+		if v == nil {
+			return nil
+		}
+		val, err := fieldValue(field, f, v)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, fn(f.name, val))
+		return nil
+	}
+	ne := func(field string, v interface{}) q.Matcher { return q.Not(q.Eq(field, v)) }
+
+	for _, op := range []struct {
+		v  interface{}
+		fn func(string, interface{}) q.Matcher
+	}{{cond.Eq, q.Eq}, {cond.Ne, ne}, {cond.Gt, q.Gt}, {cond.Gte, q.Gte}, {cond.Lt, q.Lt}, {cond.Lte, q.Lte}} {
+		if err := compare(op.v, op.fn); err != nil {
+			return nil, err
+		}
+	}
+
+	if cond.In != nil {
+		list := make([]interface{}, len(cond.In))
+		for i, v := range cond.In {
+			val, err := fieldValue(field, f, v)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = val
+		}
+		matchers = append(matchers, q.In(f.name, list))
+	}
+
+	if cond.Re != "" || cond.Prefix != "" {
+		if f.kind != stringField {
+			return nil, fmt.Errorf("re and prefix only work on text fields, not on %s", field)
+		}
+	}
+	if cond.Re != "" {
+		re, err := compileRe(field, cond.Re)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.NewFieldMatcher(f.name, text(re.MatchString)))
+	}
+	if cond.Prefix != "" {
+		prefix := cond.Prefix
+		matchers = append(matchers, q.NewFieldMatcher(f.name, text(func(s string) bool {
+			return strings.HasPrefix(s, prefix)
+		})))
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("no operator given for %s, use eq, ne, in, re, prefix, gt, gte, lt or lte", field)
+	}
+	return matchers, nil
+}
+
+// Conditions on a list field hold when any of its elements matches, ne when
+// none of them is equal. Ordering makes no sense for lists.
+func (cond Condition) listMatchers(field string, f queryField) ([]q.Matcher, error) {
+	if cond.Gt != nil || cond.Gte != nil || cond.Lt != nil || cond.Lte != nil {
+		return nil, fmt.Errorf("%s is a list, use eq, ne, in, re or prefix", field)
+	}
+
+	var matchers []q.Matcher
+	contains := func(v interface{}) (func(string) bool, error) {
+		val, err := fieldValue(field, f, v)
+		if err != nil {
+			return nil, err
+		}
+		want := val.(string)
+		return func(s string) bool { return s == want }, nil
+	}
+
+	if cond.Eq != nil {
+		match, err := contains(cond.Eq)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.NewFieldMatcher(f.name, anyElement(match)))
+	}
+	if cond.Ne != nil {
+		match, err := contains(cond.Ne)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.Not(q.NewFieldMatcher(f.name, anyElement(match))))
+	}
+	if cond.In != nil {
+		set := make(map[string]bool)
+		for _, v := range cond.In {
+			val, err := fieldValue(field, f, v)
+			if err != nil {
+				return nil, err
+			}
+			set[val.(string)] = true
+		}
+		matchers = append(matchers, q.NewFieldMatcher(f.name, anyElement(func(s string) bool { return set[s] })))
+	}
+	if cond.Re != "" {
+		re, err := compileRe(field, cond.Re)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, q.NewFieldMatcher(f.name, anyElement(re.MatchString)))
+	}
+	if cond.Prefix != "" {
+		prefix := cond.Prefix
+		matchers = append(matchers, q.NewFieldMatcher(f.name, anyElement(func(s string) bool {
+			return strings.HasPrefix(s, prefix)
+		})))
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("no operator given for %s, use eq, ne, in, re or prefix", field)
+	}
+	return matchers, nil
+}
+
+// Longest regexp re takes, Go's are linear in the input but not in their own
+// size
+const maxRegexpLen = 256
+
+// The regexp of a re condition. It's compiled for the query alone, q.Re
+// would keep it in storm's cache for good.
+func compileRe(field, expr string) (*regexp.Regexp, error) {
+	if len(expr) > maxRegexpLen {
+		return nil, fmt.Errorf("regexp for %s is too long, at most %d characters", field, maxRegexpLen)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regexp for %s: %s", field, err)
+	}
+	return re, nil
+}
+
+// Matches a text field when match holds for it
+type text func(string) bool
+
+func (match text) MatchField(v interface{}) (bool, error) {
+	s, ok := v.(string)
+	if !ok {
+		return false, fmt.Errorf("%T isn't text", v)
+	}
+	return match(s), nil
+}
+
+// Matches a list field when match holds for one of its elements
+type anyElement func(string) bool
+
+func (match anyElement) MatchField(v interface{}) (bool, error) {
+	switch list := v.(type) {
+	case []string:
+		for _, s := range list {
+			if match(s) {
+				return true, nil
+			}
+		}
+	case []Owner:
+		for _, owner := range list {
+			if match(owner.Username) {
+				return true, nil
+			}
+		}
+	default:
+		return false, fmt.Errorf("%T isn't a list", v)
+	}
+	return false, nil
+}
+
+// The storm matcher of the filter, q.True() if it's empty
+func (filter Filter) matcher() (q.Matcher, error) {
+	var matchers []q.Matcher
+
+	// Passing slice to a variadic function, learned
+	// https://blog.learngoprogramming.com/golang-variadic-funcs-how-to-patterns-369408f19085
+	if filter.Title != "" {
+		matchers = append(matchers, q.Eq("Title", filter.Title))
+	}
+	if filter.Description != "" {
+		matchers = append(matchers, q.Eq("Description", filter.Description))
+	}
+	if filter.Filename != "" {
+		matchers = append(matchers, q.Eq("Filename", filter.Filename))
+	}
+	if filter.Src != "" {
+		matchers = append(matchers, q.Eq("Src", filter.Src))
+	}
+
+	// Sorted so the same query always builds the same matcher
+	fields := make([]string, 0, len(filter.Where))
+	for field := range filter.Where {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		m, err := filter.Where[field].matchers(field)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m...)
+	}
+
+	for _, sub := range filter.And {
+		m, err := sub.matcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	if len(filter.Or) > 0 {
+		var any []q.Matcher
+		for _, sub := range filter.Or {
+			m, err := sub.matcher()
+			if err != nil {
+				return nil, err
+			}
+			any = append(any, m)
+		}
+		matchers = append(matchers, q.Or(any...))
+	}
+
+	if len(matchers) == 0 {
+		return q.True(), nil
+	}
+	return q.And(matchers...), nil
+}
+
+// Builds the storm queries of everything matching, to count it, and of the
+// page asked for, with limit, skip and order applied.
+func (query Query) selectFrom(db storm.Node) (all storm.Query, page storm.Query, err error) {
+	matcher, err := query.matcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if query.Limit < 0 || query.Skip < 0 {
+		return nil, nil, fmt.Errorf("limit and skip can't be negative")
+	}
+
+	page = db.Select(matcher)
+	if query.OrderBy != "" {
+		f, ok := queryFields[query.OrderBy]
+		if !ok {
+			return nil, nil, fmt.Errorf("can't order by unknown field %s, use one of %s", query.OrderBy, queryFieldNames())
+		}
+		if f.kind == listField {
+			return nil, nil, fmt.Errorf("can't order by %s, it's a list", query.OrderBy)
+		}
+		page = page.OrderBy(f.name)
+	}
+	if query.Reverse {
+		page = page.Reverse()
+	}
+	if query.Skip > 0 {
+		page = page.Skip(query.Skip)
+	}
+	if query.Limit > 0 {
+		page = page.Limit(query.Limit)
+	}
+	return db.Select(matcher), page, nil
+}
+
+// Query the entries in DB based on the user input JSON request
+func (e *Env) queryJSON(c *gin.Context) {
+	var userQueries Queries
+
+	// Parsing JSON, early return if error occurred
+	if c.BindJSON(&userQueries) != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Error occurred when parsing your JSON query ! X( "})
+		return
+	}
+
+	settings := e.settings()
+	if len(userQueries) > settings.maxQueries {
+		httpRejected.Inc("too_many_queries")
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("At most %d queries can be sent at once, got %d", settings.maxQueries, len(userQueries))})
+		return
+	}
+
+	results := make([]QueryResult, len(userQueries))
+	for i, userQuery := range userQueries {
+		// Total still counts every match, the rest can be paged with skip
+		if userQuery.Limit > settings.maxResults {
+			httpRejected.Inc("limit_too_large")
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Query %d: limit should be at most %d", i, settings.maxResults)})
+			return
+		}
+		if userQuery.Limit == 0 {
+			userQuery.Limit = settings.maxResults
+		}
+		all, page, err := userQuery.selectFrom(e.db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Query %d: %s", i, err)})
+			return
+		}
+
+		total, err := all.Count(&Data{})
+		if err != nil && err != storm.ErrNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		matches := []Data{}
+		err = page.Find(&matches)
+		if err != nil && err != storm.ErrNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		results[i] = QueryResult{Total: total, Matches: matches}
+		if len(matches) == 0 {
+			results[i].Message = "No match"
+		}
+	}
+
+	c.JSON(http.StatusOK, results)
+}
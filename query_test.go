@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestQueryReAndPrefix(t *testing.T) {
+	db := newTestDB(t)
+	for i, data := range []Data{
+		{Title: "Soumission", Filename: "d595.png", Metadata: Metadata{Tags: []string{"poster", "print"}}},
+		{Title: "Sous-bois", Filename: "a1b2.png", Metadata: Metadata{Tags: []string{"photo"}}},
+		{Title: "Bois (1.2)", Filename: "d5e0.jpg", Metadata: Metadata{Tags: []string{"posterity"}}},
+	} {
+		data.Provider, data.UpstreamID, data.Src = "test", string(rune('a'+i)), "http://example.com/"+string(rune('a'+i))
+		if err := upsert(db, &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		where map[string]Condition
+		want  []string
+	}{
+		{map[string]Condition{"title": {Prefix: "Sou"}}, []string{"Sous-bois", "Soumission"}},
+		// Not a regexp
+		{map[string]Condition{"title": {Prefix: "Bois (1."}}, []string{"Bois (1.2)"}},
+		{map[string]Condition{"title": {Prefix: "bois"}}, nil},
+		{map[string]Condition{"filename": {Re: `^d5.*\.png$`}}, []string{"Soumission"}},
+		{map[string]Condition{"title": {Re: "(?i)bois", Prefix: "S"}}, []string{"Sous-bois"}},
+		{map[string]Condition{"tags": {Prefix: "poster"}}, []string{"Bois (1.2)", "Soumission"}},
+		{map[string]Condition{"tags": {Re: "^p.*o$"}}, []string{"Sous-bois"}},
+	}
+	for _, tt := range tests {
+		all, _, err := Query{Filter: Filter{Where: tt.where}}.selectFrom(db)
+		if err != nil {
+			t.Fatalf("%v: %s", tt.where, err)
+		}
+		var found []Data
+		if err := all.Find(&found); err != nil && len(tt.want) > 0 {
+			t.Fatalf("%v: %s", tt.where, err)
+		}
+		var got []string
+		for _, data := range found {
+			got = append(got, data.Title)
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("%v matched %v, want %v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestQueryReErrors(t *testing.T) {
+	for _, where := range []map[string]Condition{
+		{"title": {Re: "("}},
+		{"title": {Re: strings.Repeat("a", maxRegexpLen+1)}},
+		{"tags": {Re: strings.Repeat("a", maxRegexpLen+1)}},
+		{"size": {Prefix: "1"}},
+	} {
+		if _, err := (Filter{Where: where}).matcher(); err == nil {
+			t.Errorf("%v: no error", where)
+		}
+	}
+
+	// GET / takes the same operators
+	req, err := parseListRequest(url.Values{"title.re": {strings.Repeat("a", maxRegexpLen+1)}})
+	if err == nil {
+		_, err = req.filter.matcher()
+	}
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("?title.re= with a long regexp: err = %v, want too long", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults of the limits, see LimitsConfig
+const (
+	defaultRateLimit  = 50
+	defaultRateBurst  = 100
+	defaultMaxQueries = 20
+	defaultMaxResults = maxPageSize
+)
+
+// Forget the buckets of clients idle for that long
+const rateLimitSweep = time.Minute
+
+// RateLimiter is a token bucket per client. Each one holds up to burst
+// tokens and gets rate tokens per second back, every request takes one.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Takes a token of client. When there is none, wait is how long until there
+// is one again.
+func (l *RateLimiter) Take(client string) (ok bool, remaining int, wait time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateLimitSweep {
+		l.sweep(now)
+	}
+
+	b, found := l.buckets[client]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, 0, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// Drops the buckets that are full again, they are the same as new ones.
+// Callers hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Limits the requests of each IP. It goes before authorize, so requests
+// without a key, or with a wrong one, are limited too.
+func (e *Env) rateLimitIP(c *gin.Context) {
+	s := e.settings()
+	if s.limiter != nil {
+		rateLimit(c, s.limiter, "ip:"+s.proxies.clientIP(c.Request))
+	}
+}
+
+// Limits the requests of each API key, wherever they come from. It goes
+// after authorize.
+func (e *Env) rateLimitKey(c *gin.Context) {
+	limiter := e.settings().limiter
+	name, ok := c.Get(apiKeyName)
+	if limiter != nil && ok {
+		rateLimit(c, limiter, "key:"+name.(string))
+	}
+}
+
+// Refuses the request with a 429 when client went over its rate
+func rateLimit(c *gin.Context, limiter *RateLimiter, client string) {
+	ok, remaining, wait := limiter.Take(client)
+	// The IP may have fewer left than the key
+	if prev, err := strconv.Atoi(c.Writer.Header().Get("X-RateLimit-Remaining")); err == nil && prev < remaining {
+		remaining = prev
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !ok {
+		httpRejected.Inc("rate_limit")
+		seconds := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"message": fmt.Sprintf("Too many requests, try again in %ds", seconds)})
+	}
+}
+
+// TrustedProxies are the proxies of limits.trusted_proxies
+type TrustedProxies struct {
+	nets []*net.IPNet
+	// Whether the connections to Unix sockets come from a proxy
+	unix bool
+}
+
+// Parses limits.trusted_proxies, nil when it has none
+func parseTrustedProxies(list string) (*TrustedProxies, error) {
+	p := &TrustedProxies{}
+	for _, proxy := range strings.Split(list, ",") {
+		proxy = strings.TrimSpace(proxy)
+		switch {
+		case proxy == "":
+		case proxy == "unix":
+			p.unix = true
+		case strings.Contains(proxy, "/"):
+			_, n, err := net.ParseCIDR(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("%s isn't an IP or a CIDR", proxy)
+			}
+			p.nets = append(p.nets, n)
+		default:
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%s isn't an IP or a CIDR", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.nets = append(p.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	if len(p.nets) == 0 && !p.unix {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func (p *TrustedProxies) trusts(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IP the request comes from. It's the address of the connection, unless
+// that's a trusted proxy: then it's the last address of X-Forwarded-For
+// that isn't one. Connections to Unix sockets have an address each, see
+// listenOn. Unlike gin's ClientIP, the X-Forwarded-For of anyone else is
+// ignored, clients can write anything in it.
+func (p *TrustedProxies) clientIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if strings.HasPrefix(addr, unixPrefix) {
+		if p == nil || !p.unix {
+			return addr
+		}
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		if !p.trusts(net.ParseIP(host)) {
+			return host
+		}
+		addr = host
+	}
+
+	// Each proxy appends the address it got the request from
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		addr = ip.String()
+		if !p.trusts(ip) {
+			break
+		}
+	}
+	return addr
+}
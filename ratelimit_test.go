@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, ::1, unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		proxies    *TrustedProxies
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		// Not from a proxy, X-Forwarded-For is made up
+		{nil, "203.0.113.7:5123", []string{"1.2.3.4"}, "203.0.113.7"},
+		{trusted, "203.0.113.7:5123", []string{"1.2.3.4"}, "203.0.113.7"},
+		{trusted, "10.1.2.3:5123", nil, "10.1.2.3"},
+		{trusted, "10.1.2.3:5123", []string{"198.51.100.2"}, "198.51.100.2"},
+		// Only the part the proxies added counts
+		{trusted, "10.1.2.3:5123", []string{"1.2.3.4, 198.51.100.2, 192.168.1.1"}, "198.51.100.2"},
+		{trusted, "10.1.2.3:5123", []string{"1.2.3.4", "198.51.100.2, 10.9.9.9"}, "198.51.100.2"},
+		{trusted, "10.1.2.3:5123", []string{"1.2.3.4, not-an-ip, 10.9.9.9"}, "10.9.9.9"},
+		{trusted, "192.168.1.2:5123", []string{"1.2.3.4"}, "192.168.1.2"},
+		{trusted, "[::1]:5123", []string{"2001:db8::1"}, "2001:db8::1"},
+		// Each connection to a socket is a client, unless a proxy uses it
+		{nil, "unix:/run/foli.sock#3", []string{"1.2.3.4"}, "unix:/run/foli.sock#3"},
+		{trusted, "unix:/run/foli.sock#3", []string{"1.2.3.4"}, "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := tt.proxies.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if p, err := parseTrustedProxies(" , "); p != nil || err != nil {
+		t.Errorf("an empty list = %v, %v, want nil, nil", p, err)
+	}
+	for _, list := range []string{"10.0.0.0/33", "localhost", "10.0.0.1, 10.0.0"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("%s: no error", list)
+		}
+	}
+}
+
+func TestUnixConnectionsHaveTheirOwnAddress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foli.sock")
+	ln, err := listenOn(unixPrefix+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	addrs := make(chan string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			addrs <- conn.RemoteAddr().String()
+			conn.Close()
+		}
+	}()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := <-addrs
+		conn.Close()
+		if seen[addr] {
+			t.Fatalf("two connections have the address %s", addr)
+		}
+		seen[addr] = true
+	}
+}
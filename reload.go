@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"time"
+)
+
+// Settings are the parts of Env that a SIGHUP can change. Handlers read them
+// with e.settings(), a reload swaps them all at once.
+type Settings struct {
+	// See serveImage
+	imageServe  string
+	imageURLTTL time.Duration
+	// Whether /readyz waits for the first crawl
+	readyAfterFirstCrawl bool
+	// Whether requests need an API key, see authorize
+	authEnabled bool
+	// nil when requests aren't rate limited
+	limiter *RateLimiter
+	// Whose X-Forwarded-For is believed, see clientIP
+	proxies *TrustedProxies
+	// Caps of POST /q, on the queries and on the matches of each one
+	maxQueries int
+	maxResults int
+	// nil when responses aren't cached
+	cache *ResponseCache
+}
+
+// The settings of cfg. The rate limiter and the response cache of old are
+// kept when their config didn't change, so a reload doesn't reset them. The
+// cache also has to go when anything the cached responses depend on changed,
+// e.g. a lower limits.max_results.
+func newSettings(cfg *Config, old *Settings) *Settings {
+	s := &Settings{
+		imageServe:           cfg.Images.Serve,
+		imageURLTTL:          cfg.Images.URLTTL,
+		readyAfterFirstCrawl: cfg.Crawl.ReadyAfterFirst,
+		authEnabled:          cfg.Auth.Enabled,
+		maxQueries:           cfg.Limits.MaxQueries,
+		maxResults:           cfg.Limits.MaxResults,
+	}
+	// validate made sure it parses
+	s.proxies, _ = parseTrustedProxies(cfg.Limits.TrustedProxies)
+	if cfg.Limits.Rate > 0 {
+		if old != nil && old.limiter != nil && old.limiter.rate == cfg.Limits.Rate && old.limiter.burst == float64(cfg.Limits.Burst) {
+			s.limiter = old.limiter
+		} else {
+			s.limiter = NewRateLimiter(cfg.Limits.Rate, cfg.Limits.Burst)
+		}
+	}
+	if budget := int64(cfg.Cache.SizeMB) << 20; budget > 0 {
+		if old != nil && old.cache != nil && old.cache.budget == budget && sameResponses(old, s) {
+			s.cache = old.cache
+		} else {
+			s.cache = NewResponseCache(budget)
+		}
+	}
+	return s
+}
+
+// Whether the entry routes answer the same with a and b. Their responses are
+// cached after auth, but whether it's on is checked too so the cache never
+// outlives a change in who may read.
+func sameResponses(a, b *Settings) bool {
+	return a.maxQueries == b.maxQueries && a.maxResults == b.maxResults && a.authEnabled == b.authEnabled
+}
+
+func (e *Env) settings() *Settings {
+	return e.live.Load().(*Settings)
+}
+
+// Reads the config again on SIGHUP and applies what can change while
+// serving: the log level, auth, the limits and trusted proxies, the
+// response cache, how covers are served and the crawl schedule. The rest
+// needs a restart, changing it is only logged. A config that doesn't load
+// or isn't valid is ignored.
+func (e *Env) reload(cfg *Config) *Config {
+	next, err := loadConfig(cfg.path)
+	if err == nil {
+		// -listen and -db win over the file, and need a restart anyway
+		next.Listen, next.DB = cfg.Listen, cfg.DB
+		err = next.validate(e.crawling)
+	}
+	if err != nil {
+		logger.Error("Can't reload the config, keeping the current one", "error", err)
+		return cfg
+	}
+
+	for _, setting := range []struct {
+		name      string
+		old, next interface{}
+	}{
+		{"socket_mode", cfg.SocketMode, next.SocketMode},
+		{"api", cfg.API, next.API},
+		{"fixture", cfg.Fixture, next.Fixture},
+		{"http", cfg.HTTP, next.HTTP},
+		{"images.dir", cfg.Images.Dir, next.Images.Dir},
+		{"images.store", cfg.Images.Store, next.Images.Store},
+		{"images.max_size_mb", cfg.Images.MaxSizeMB, next.Images.MaxSizeMB},
+		{"s3", cfg.S3, next.S3},
+		{"thumbs", cfg.Thumbs, next.Thumbs},
+		{"log.format", cfg.Log.Format, next.Log.Format},
+		{"tls", cfg.TLS, next.TLS},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.next) {
+			logger.Warn("Restart foli to apply the change", "setting", setting.name)
+		}
+	}
+	if (cfg.Crawl.Interval > 0) != (next.Crawl.Interval > 0) {
+		logger.Warn("Restart foli to start or stop crawling in the background", "setting", "crawl.interval")
+		next.Crawl.Interval = cfg.Crawl.Interval
+	}
+
+	level, _ := parseLevel(next.Log.Level)
+	logger.SetLevel(level)
+	e.live.Store(newSettings(next, e.settings()))
+	if e.crawling {
+		e.scheduler.Reconfigure(next.Crawl.Interval, next.Crawl.Pages, next.Crawl.Workers)
+	}
+	logger.Info("Config reloaded", "file", next.path)
+	return next
+}
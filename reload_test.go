@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewSettingsKeepsTheCacheOnlyIfResponsesAreTheSame(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Cache.SizeMB = 1
+	old := newSettings(cfg, nil)
+	if kept := newSettings(cfg, old); kept.cache != old.cache {
+		t.Error("a reload changing nothing dropped the cache")
+	}
+
+	for name, change := range map[string]func(*Config){
+		"cache.size_mb":      func(c *Config) { c.Cache.SizeMB = 2 },
+		"limits.max_results": func(c *Config) { c.Limits.MaxResults = 10 },
+		"limits.max_queries": func(c *Config) { c.Limits.MaxQueries = 1 },
+		"auth.enabled":       func(c *Config) { c.Auth.Enabled = false },
+	} {
+		next := *cfg
+		change(&next)
+		if s := newSettings(&next, old); s.cache == old.cache || s.cache == nil {
+			t.Errorf("%s changed, the cache is kept", name)
+		}
+	}
+
+	next := *cfg
+	next.Limits.Rate = 1
+	if s := newSettings(&next, old); s.cache != old.cache {
+		t.Error("limits.rate changed, the cache is dropped")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // registers GIF for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Biggest thumbnail we make, and biggest source image we agree to decode
+const (
+	maxThumbSide   = 4096
+	maxSourcePixel = 50 * 1000 * 1000
+)
+
+// How a thumbnail is fitted in the requested box
+const (
+	// Scaled to fit inside the box, keeping its aspect ratio
+	fitContain = "contain"
+	// Scaled to cover the box, keeping its aspect ratio, and cropped to it
+	fitCover = "cover"
+	// Stretched to the box
+	fitFill = "fill"
+)
+
+// ThumbSpec is what GET /imgs/:name?w=&h=&fit=&format= asks for
+type ThumbSpec struct {
+	Width  int
+	Height int
+	Fit    string
+	Format string
+}
+
+// Parses the query of a thumbnail request, ok is false when none of the
+// parameters are given, i.e. the original is wanted.
+func parseThumbSpec(w, h, fit, format string) (spec ThumbSpec, ok bool, err error) {
+	if w == "" && h == "" && fit == "" && format == "" {
+		return spec, false, nil
+	}
+
+	side := func(name, val string) (int, error) {
+		if val == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 || n > maxThumbSide {
+			return 0, fmt.Errorf("%s should be between 1 and %d", name, maxThumbSide)
+		}
+		return n, nil
+	}
+	if spec.Width, err = side("w", w); err != nil {
+		return spec, true, err
+	}
+	if spec.Height, err = side("h", h); err != nil {
+		return spec, true, err
+	}
+
+	switch fit {
+	case "":
+		spec.Fit = fitContain
+	case fitContain, fitCover, fitFill:
+		spec.Fit = fit
+	default:
+		return spec, true, fmt.Errorf("fit should be %s, %s or %s", fitContain, fitCover, fitFill)
+	}
+	if spec.Fit != fitContain && (spec.Width == 0 || spec.Height == 0) {
+		return spec, true, fmt.Errorf("fit=%s needs both w and h", spec.Fit)
+	}
+
+	switch format {
+	case "", "jpeg", "png", "webp":
+		spec.Format = format
+	case "jpg":
+		spec.Format = "jpeg"
+	default:
+		return spec, true, fmt.Errorf("format should be jpeg, png or webp")
+	}
+	return spec, true, nil
+}
+
+// The format the thumbnail is encoded in. There is no WebP encoder in the
+// standard library, so asking for WebP gets the source format (PNG stays
+// PNG, everything else becomes JPEG) with the right Content-Type.
+func (spec ThumbSpec) outputFormat(source string) string {
+	if spec.Format == "jpeg" || spec.Format == "png" {
+		return spec.Format
+	}
+	if source == "png" {
+		return "png"
+	}
+	return "jpeg"
+}
+
+// Decodes data, resizes it as spec says and encodes it to w in format
+func makeThumb(w io.Writer, data []byte, spec ThumbSpec, format string) error {
+	// The header says how big the image is, before it's decoded
+	if _, err := thumbSource(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	dst := resize(src, spec)
+
+	switch format {
+	case "png":
+		return png.Encode(w, dst)
+	default:
+		// JPEG has no alpha, transparent areas become white instead of black
+		flat := image.NewRGBA(dst.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+		draw.Draw(flat, flat.Bounds(), dst, dst.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: 85})
+	}
+}
+
+// Checks the source isn't too big to decode, and returns its format
+func thumbSource(r io.Reader) (string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return "", fmt.Errorf("image has no pixels (%dx%d)", cfg.Width, cfg.Height)
+	}
+	// Divided, the product of huge sides could overflow
+	if cfg.Width > maxSourcePixel/cfg.Height {
+		return "", fmt.Errorf("image is too big to resize (%dx%d)", cfg.Width, cfg.Height)
+	}
+	return format, nil
+}
+
+func resize(src image.Image, spec ThumbSpec) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw == 0 || sh == 0 {
+		return src
+	}
+
+	w, h := spec.Width, spec.Height
+	switch spec.Fit {
+	case fitFill:
+		return scale(src, w, h)
+	case fitCover:
+		ratio := math.Max(float64(w)/float64(sw), float64(h)/float64(sh))
+		scaled := scale(src, atLeast(w, float64(sw)*ratio), atLeast(h, float64(sh)*ratio))
+		sb := scaled.Bounds()
+		x, y := (sb.Dx()-w)/2, (sb.Dy()-h)/2
+		return scaled.SubImage(image.Rect(x, y, x+w, y+h))
+	default:
+		// Only one side given, the other follows the aspect ratio
+		ratio := math.Inf(1)
+		if w > 0 {
+			ratio = float64(w) / float64(sw)
+		}
+		if h > 0 {
+			ratio = math.Min(ratio, float64(h)/float64(sh))
+		}
+		if math.IsInf(ratio, 1) {
+			ratio = 1
+		}
+		return scale(src, atLeast(1, float64(sw)*ratio), atLeast(1, float64(sh)*ratio))
+	}
+}
+
+func atLeast(min int, f float64) int {
+	n := int(math.Round(f))
+	if n < min {
+		return min
+	}
+	return n
+}
+
+// Resamples src to w x h with a triangle (bilinear) filter, widened when
+// shrinking so every source pixel counts. Done in two separable passes,
+// first along x then along y.
+func scale(src image.Image, w, h int) *image.NRGBA {
+	b := src.Bounds()
+	in := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(in, in.Bounds(), src, b.Min, draw.Src)
+
+	tmp := image.NewNRGBA(image.Rect(0, 0, w, b.Dy()))
+	resampleAxis(tmp.Pix, in.Pix, b.Dx(), w, b.Dy(), 4, in.Stride, 4, tmp.Stride)
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	resampleAxis(out.Pix, tmp.Pix, b.Dy(), h, w, tmp.Stride, 4, out.Stride, 4)
+	return out
+}
+
+// Resizes lines of srcLen pixels to dstLen pixels. Along a line pixels are
+// srcStep (dstStep) bytes apart, and lines start srcLine (dstLine) bytes
+// apart, which lets the same loop do rows and columns.
+func resampleAxis(dst, src []uint8, srcLen, dstLen, lines, srcStep, srcLine, dstStep, dstLine int) {
+	ratio := float64(srcLen) / float64(dstLen)
+	support := math.Max(ratio, 1)
+
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*ratio - 0.5
+		start := int(math.Floor(center - support))
+		end := int(math.Ceil(center + support))
+
+		for line := 0; line < lines; line++ {
+			var r, g, b, a, total float64
+			for j := start; j <= end; j++ {
+				weight := 1 - math.Abs(float64(j)-center)/support
+				if weight <= 0 {
+					continue
+				}
+				k := j
+				if k < 0 {
+					k = 0
+				} else if k >= srcLen {
+					k = srcLen - 1
+				}
+				p := src[line*srcLine+k*srcStep:]
+				// Weight colours by alpha, so transparent pixels don't bleed
+				pa := float64(p[3]) * weight
+				r += float64(p[0]) * pa
+				g += float64(p[1]) * pa
+				b += float64(p[2]) * pa
+				a += pa
+				total += weight
+			}
+
+			q := dst[line*dstLine+i*dstStep:]
+			if a > 0 {
+				q[0] = clamp8(r / a)
+				q[1] = clamp8(g / a)
+				q[2] = clamp8(b / a)
+			} else {
+				q[0], q[1], q[2] = 0, 0, 0
+			}
+			if total > 0 {
+				q[3] = clamp8(a / total)
+			}
+		}
+	}
+}
+
+func clamp8(f float64) uint8 {
+	if f <= 0 {
+		return 0
+	}
+	if f >= 255 {
+		return 255
+	}
+	return uint8(f + 0.5)
+}
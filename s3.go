@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 wants this as the payload hash when the body isn't hashed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Presigned URLs can't last longer than a week, S3 refuses them otherwise
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// S3Store keeps blobs in a bucket of an S3 compatible service (AWS, MinIO,
+// ...). Requests use path style URLs, endpoint/bucket/key, which every
+// implementation understands, and are signed with AWS Signature Version 4.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type S3Store struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string) (*S3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint %s: %s", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("s3: endpoint %s should start with http:// or https://", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("s3: no bucket given")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// An S3 PUT is atomic already, the object shows up once it is complete
+func (s *S3Store) Put(key string, r io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(key string) (Blob, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Blob{ReadCloser: resp.Body, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *S3Store) Exists(key string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, s.objectURL(key), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if err == ErrBlobNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *S3Store) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// A presigned GET URL, anyone holding it can fetch the blob until it expires.
+// expires is cut down to a week, the longest S3 allows.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (s *S3Store) URL(key string, expires time.Duration) (string, error) {
+	return s.presign(key, expires, time.Now().UTC())
+}
+
+func (s *S3Store) presign(key string, expires time.Duration, now time.Time) (string, error) {
+	u, err := url.Parse(s.objectURL(key))
+	if err != nil {
+		return "", err
+	}
+	if expires > maxPresignExpiry {
+		expires = maxPresignExpiry
+	}
+	if expires < time.Second {
+		expires = time.Second
+	}
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(query)
+
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	signature := s.signature(now, http.MethodGet, u, header, unsignedPayload)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+func (s *S3Store) objectURL(key string) string {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	return u.String()
+}
+
+// Signs req and sends it, a 404 comes back as ErrBlobNotFound and any other
+// non 2xx as an error carrying the S3 error body.
+func (s *S3Store) do(req *http.Request) (*http.Response, error) {
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signed := http.Header{}
+	signed.Set("Host", req.URL.Host)
+	signed.Set("X-Amz-Date", req.Header.Get("X-Amz-Date"))
+	signed.Set("X-Amz-Content-Sha256", unsignedPayload)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		s.accessKey, s.scope(now), s.signature(now, req.Method, req.URL, signed, unsignedPayload),
+	))
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("s3: %s %s responded %d: %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// Signs every header in header, the caller lists the same names in
+// SignedHeaders.
+func (s *S3Store) signature(t time.Time, method string, u *url.URL, header http.Header, payloadHash string) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(u.Query()),
+		canonicalHeaders.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Sorted by key and escaped the way SigV4 expects, spaces as %20
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type s3Blob struct {
+	io.ReadCloser
+	size    int64
+	modTime time.Time
+}
+
+func (b *s3Blob) Size() int64        { return b.size }
+func (b *s3Blob) ModTime() time.Time { return b.modTime }
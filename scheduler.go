@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How often the background sync runs, unless crawl.interval says otherwise
+const defaultSyncInterval = time.Hour
+
+// Only the latest errors of a run are kept for the status
+const maxReportedErrors = 20
+
+// Scheduler crawls the provider in the background, once right away and then
+// on every interval, so the server doesn't have to wait for a crawl to start.
+// Since saving is an upsert and crawls resume from their checkpoint, every
+// run only adds or refreshes what changed.
+type Scheduler struct {
+	crawler  *Crawler
+	interval time.Duration
+
+	mu      sync.Mutex
+	running bool
+	lastRun *SyncRun
+	nextRun time.Time
+
+	// Set by Start, see Stop and Wait
+	cancel context.CancelFunc
+	done   chan struct{}
+	// Tells the loop the interval changed
+	wake chan struct{}
+}
+
+// SyncRun is the outcome of one background sync
+type SyncRun struct {
+	// The run_id of its log lines
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Saved      int       `json:"saved"`
+	Failed     int       `json:"failed"`
+	// Set when the crawl had to stop early, it resumes on the next run
+	Stopped string   `json:"stopped,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// SyncStatus is what /sync responds with
+type SyncStatus struct {
+	Provider string    `json:"provider"`
+	Running  bool      `json:"running"`
+	Interval string    `json:"interval"`
+	LastRun  *SyncRun  `json:"last_run"`
+	NextRun  time.Time `json:"next_run"`
+	// How many entries are in the DB right now
+	Total int `json:"total"`
+	// Request counters of the upstream client, by endpoint
+	Upstream map[string]EndpointStats `json:"upstream"`
+}
+
+func NewScheduler(crawler *Crawler, interval time.Duration) *Scheduler {
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	return &Scheduler{crawler: crawler, interval: interval, wake: make(chan struct{}, 1)}
+}
+
+// Starts syncing in the background, until ctx is done or Stop is called
+func (s *Scheduler) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.mu.Lock()
+	s.nextRun = time.Now()
+	s.cancel, s.done = cancel, make(chan struct{})
+	s.mu.Unlock()
+
+	go func() {
+		defer close(s.done)
+		for {
+			s.run(ctx)
+
+			s.mu.Lock()
+			s.nextRun = time.Now().Add(s.interval)
+			s.mu.Unlock()
+			if !s.sleep(ctx) {
+				return
+			}
+		}
+	}()
+}
+
+// Waits for the next run, false once the scheduler is stopping
+func (s *Scheduler) sleep(ctx context.Context) bool {
+	for {
+		s.mu.Lock()
+		wait := time.Until(s.nextRun)
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return true
+		case <-s.wake:
+			// nextRun moved, wait for the new one
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// Interrupts the running crawl and stops scheduling new ones
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Waits for the crawl interrupted by Stop to save what it already downloaded,
+// or for ctx to be done
+func (s *Scheduler) Wait(ctx context.Context) error {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Applies a reloaded config, from the next crawl on. A new interval counts
+// from the end of the last crawl.
+func (s *Scheduler) Reconfigure(interval time.Duration, pages, workers int) {
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	s.mu.Lock()
+	crawler := *s.crawler
+	crawler.pages, crawler.workers = pages, workers
+	s.crawler = &crawler
+	if interval != s.interval && !s.running {
+		s.nextRun = s.nextRun.Add(interval - s.interval)
+	}
+	s.interval = interval
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	s.mu.Lock()
+	s.running = true
+	crawler := s.crawler
+	s.mu.Unlock()
+
+	run := &SyncRun{StartedAt: time.Now()}
+	result, err := crawler.fetchItem(ctx)
+	if err != nil {
+		run.Stopped = err.Error()
+	}
+	run.ID = result.RunID
+	run.FinishedAt = time.Now()
+	run.Saved = result.Saved
+	run.Failed = len(result.Errors)
+
+	errs := result.Errors
+	if len(errs) > maxReportedErrors {
+		errs = errs[len(errs)-maxReportedErrors:]
+	}
+	for _, e := range errs {
+		run.Errors = append(run.Errors, e.Error())
+	}
+
+	s.mu.Lock()
+	s.running = false
+	s.lastRun = run
+	s.mu.Unlock()
+}
+
+// The outcome of the last crawl, nil until the first one is over
+func (s *Scheduler) LastRun() *SyncRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastRun
+}
+
+// Whether a crawl is running right now
+func (s *Scheduler) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *Scheduler) Status() SyncStatus {
+	s.mu.Lock()
+	status := SyncStatus{
+		Running:  s.running,
+		Interval: s.interval.String(),
+		LastRun:  s.lastRun,
+		NextRun:  s.nextRun,
+	}
+	crawler := s.crawler
+	s.mu.Unlock()
+	status.Upstream = crawler.client.Stats()
+	// There is none when serve doesn't crawl
+	if crawler.provider != nil {
+		status.Provider = crawler.provider.Name()
+	}
+
+	total, err := crawler.db.Count(&Data{})
+	if err != nil {
+		logger.Error("Counting entries failed", "error", err)
+	}
+	status.Total = total
+	return status
+}
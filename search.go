@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+	"github.com/gin-gonic/gin"
+)
+
+// The inverted index lives in these buckets of foli.db, next to what storm
+// keeps, and is updated in the same transaction as the entries.
+var (
+	// term -> postings, a list of (entry ID, weighted term frequency)
+	searchTermsBucket = []byte("search_terms")
+	// entry ID -> the terms it was indexed with, to take them out again
+	searchDocsBucket = []byte("search_docs")
+	// document count, total length and index version
+	searchMetaBucket = []byte("search_meta")
+)
+
+// Bump when tokenize or stem change, the index is rebuilt on startup
+const searchIndexVersion = 2
+
+// A postings list that doesn't decode
+var errCorruptPostings = errors.New("corrupt postings list in the search index")
+
+// A term in the title counts as much as this many in the description
+const titleBoost = 3
+
+// BM25 parameters
+// https://en.wikipedia.org/wiki/Okapi_BM25
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// A prefix expands to at most that many terms, and counts for less than an
+// exact match
+const (
+	maxPrefixTerms = 50
+	prefixWeight   = 0.7
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	snippetWords       = 30
+)
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"by": true, "for": true, "from": true, "has": true, "in": true, "is": true, "it": true,
+	"its": true, "of": true, "on": true, "or": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "were": true, "will": true, "with": true,
+}
+
+// A word of a text and where it is
+type token struct {
+	word       string
+	start, end int
+}
+
+// Splits text on anything that isn't a letter or a digit, lowercased
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// The terms of text as they go in the index, stop words left out
+func terms(text string) []string {
+	var out []string
+	for _, t := range tokenize(text) {
+		if stopWords[t.word] {
+			continue
+		}
+		out = append(out, stem(t.word))
+	}
+	return out
+}
+
+// A light English stemmer, taking off plurals and the usual verb and noun
+// endings, in the spirit of the first steps of Porter's.
+// https://tartarus.org/martin/PorterStemmer/
+func stem(word string) string {
+	if utf8.RuneCountInString(word) <= 3 {
+		return word
+	}
+
+	switch {
+	// sketches -> sketch, boxes -> box, classes -> class
+	case strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "ches"),
+		strings.HasSuffix(word, "shes"), strings.HasSuffix(word, "xes"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+	// So caches and cache end up the same, as caches -> cach above
+	if strings.HasSuffix(word, "che") {
+		word = word[:len(word)-1]
+	}
+
+	for _, suffix := range []string{"ational", "ization", "fulness", "iveness", "ation", "ness", "ment", "ing", "ed", "ly"} {
+		if !strings.HasSuffix(word, suffix) || len(word)-len(suffix) < 3 {
+			continue
+		}
+		stemmed := word[:len(word)-len(suffix)]
+		if !hasVowel(stemmed) {
+			break
+		}
+		word = stemmed
+		// sketching -> sketch, running -> run
+		if (suffix == "ing" || suffix == "ed") && doubled(word) {
+			word = word[:len(word)-1]
+		}
+		break
+	}
+	return word
+}
+
+func hasVowel(word string) bool {
+	return strings.ContainsAny(word, "aeiouy")
+}
+
+func doubled(word string) bool {
+	n := len(word)
+	return n >= 2 && word[n-1] == word[n-2] && !strings.ContainsAny(word[n-1:], "lsz")
+}
+
+// What an entry was indexed with, kept in searchDocsBucket
+type indexedDoc struct {
+	Terms  map[string]int `json:"terms"`
+	Length int            `json:"length"`
+}
+
+type searchMeta struct {
+	Version     int `json:"version"`
+	Docs        int `json:"docs"`
+	TotalLength int `json:"total_length"`
+}
+
+func docTerms(data *Data) indexedDoc {
+	doc := indexedDoc{Terms: make(map[string]int)}
+	for _, term := range terms(data.Title) {
+		doc.Terms[term] += titleBoost
+		doc.Length += titleBoost
+	}
+	for _, term := range terms(data.Description) {
+		doc.Terms[term]++
+		doc.Length++
+	}
+	return doc
+}
+
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// Postings are pairs of uvarints, entry ID and frequency, sorted by ID
+func decodePostings(b []byte) (map[int]int, error) {
+	postings := make(map[int]int)
+	for len(b) > 0 {
+		id, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errCorruptPostings
+		}
+		b = b[n:]
+		tf, m := binary.Uvarint(b)
+		if m <= 0 {
+			return nil, errCorruptPostings
+		}
+		b = b[m:]
+		postings[int(id)] = int(tf)
+	}
+	return postings, nil
+}
+
+func encodePostings(postings map[int]int) []byte {
+	ids := make([]int, 0, len(postings))
+	for id := range postings {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var buf bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, id := range ids {
+		buf.Write(tmp[:binary.PutUvarint(tmp, uint64(id))])
+		buf.Write(tmp[:binary.PutUvarint(tmp, uint64(postings[id]))])
+	}
+	return buf.Bytes()
+}
+
+func searchBuckets(tx *bolt.Tx) (termsB, docsB, metaB *bolt.Bucket, err error) {
+	if termsB, err = tx.CreateBucketIfNotExists(searchTermsBucket); err != nil {
+		return
+	}
+	if docsB, err = tx.CreateBucketIfNotExists(searchDocsBucket); err != nil {
+		return
+	}
+	metaB, err = tx.CreateBucketIfNotExists(searchMetaBucket)
+	return
+}
+
+func readSearchMeta(metaB *bolt.Bucket) searchMeta {
+	var meta searchMeta
+	if raw := metaB.Get([]byte("meta")); raw != nil {
+		json.Unmarshal(raw, &meta)
+	}
+	return meta
+}
+
+func writeSearchMeta(metaB *bolt.Bucket, meta searchMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return metaB.Put([]byte("meta"), raw)
+}
+
+// Puts data in the index, replacing what it was indexed with before
+func indexDocument(tx *bolt.Tx, data *Data) error {
+	if err := unindexDocument(tx, data.ID); err != nil {
+		return err
+	}
+	termsB, docsB, metaB, err := searchBuckets(tx)
+	if err != nil {
+		return err
+	}
+
+	doc := docTerms(data)
+	for term, tf := range doc.Terms {
+		postings, err := decodePostings(termsB.Get([]byte(term)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", term, err)
+		}
+		postings[data.ID] = tf
+		if err := termsB.Put([]byte(term), encodePostings(postings)); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := docsB.Put(idKey(data.ID), raw); err != nil {
+		return err
+	}
+
+	meta := readSearchMeta(metaB)
+	meta.Docs++
+	meta.TotalLength += doc.Length
+	return writeSearchMeta(metaB, meta)
+}
+
+// Takes the entry id out of the index, if it's there
+func unindexDocument(tx *bolt.Tx, id int) error {
+	termsB, docsB, metaB, err := searchBuckets(tx)
+	if err != nil {
+		return err
+	}
+	raw := docsB.Get(idKey(id))
+	if raw == nil {
+		return nil
+	}
+	var doc indexedDoc
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+
+	for term := range doc.Terms {
+		postings, err := decodePostings(termsB.Get([]byte(term)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", term, err)
+		}
+		delete(postings, id)
+		if len(postings) == 0 {
+			err = termsB.Delete([]byte(term))
+		} else {
+			err = termsB.Put([]byte(term), encodePostings(postings))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := docsB.Delete(idKey(id)); err != nil {
+		return err
+	}
+
+	meta := readSearchMeta(metaB)
+	meta.Docs--
+	meta.TotalLength -= doc.Length
+	return writeSearchMeta(metaB, meta)
+}
+
+// Rebuilds the index from scratch if it was built by another version, or
+// never built, e.g. for a foli.db from before search existed.
+func ensureSearchIndex(db *storm.DB) error {
+	var meta searchMeta
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(searchMetaBucket); b != nil {
+			meta = readSearchMeta(b)
+		}
+		return nil
+	})
+	if err != nil || meta.Version == searchIndexVersion {
+		return err
+	}
+
+	logger.Info("Building the search index")
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{searchTermsBucket, searchDocsBucket, searchMetaBucket} {
+			if tx.Bucket(name) != nil {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		err := db.WithTransaction(tx).Select().Each(new(Data), func(record interface{}) error {
+			return indexDocument(tx, record.(*Data))
+		})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+
+		_, _, metaB, err := searchBuckets(tx)
+		if err != nil {
+			return err
+		}
+		meta := readSearchMeta(metaB)
+		meta.Version = searchIndexVersion
+		return writeSearchMeta(metaB, meta)
+	})
+}
+
+// SearchResult is one hit of /search
+type SearchResult struct {
+	Score float64 `json:"score"`
+	Item  Data    `json:"item"`
+	// Title and a piece of the description, HTML escaped, matches wrapped
+	// in <mark>
+	Highlights map[string]string `json:"highlights"`
+}
+
+// A term of the query, with the index terms it matches
+type queryTerm struct {
+	word   string
+	prefix bool
+	// index term -> weight
+	matches map[string]float64
+}
+
+// Parses the user query. Each word matches its stem, the last word (as
+// you're likely still typing it) and words ending with * match as prefixes.
+func parseSearchQuery(query string) []*queryTerm {
+	tokens := tokenize(query)
+	trimmed := strings.TrimSpace(query)
+
+	var out []*queryTerm
+	for i, t := range tokens {
+		explicit := strings.HasPrefix(query[t.end:], "*")
+		last := i == len(tokens)-1 && t.end == len(trimmed)
+		if stopWords[t.word] && !explicit && !last {
+			continue
+		}
+		out = append(out, &queryTerm{word: t.word, prefix: explicit || last})
+	}
+	return out
+}
+
+// Finds the index terms each query term matches
+func (qt *queryTerm) expand(termsB *bolt.Bucket) {
+	qt.matches = make(map[string]float64)
+	exact := stem(qt.word)
+	if termsB.Get([]byte(exact)) != nil {
+		qt.matches[exact] = 1
+	}
+	if !qt.prefix {
+		return
+	}
+
+	c := termsB.Cursor()
+	prefix := []byte(qt.word)
+	n := 0
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && n < maxPrefixTerms; k, _ = c.Next() {
+		if _, ok := qt.matches[string(k)]; !ok {
+			qt.matches[string(k)] = prefixWeight
+		}
+		n++
+	}
+}
+
+// Ranks the entries matching every term of the query with BM25
+func search(db *storm.DB, query string, limit, offset int) (int, []SearchResult, error) {
+	qterms := parseSearchQuery(query)
+	if len(qterms) == 0 {
+		return 0, nil, nil
+	}
+
+	scores := make(map[int]float64)
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		termsB, docsB, metaB := tx.Bucket(searchTermsBucket), tx.Bucket(searchDocsBucket), tx.Bucket(searchMetaBucket)
+		if termsB == nil || docsB == nil || metaB == nil {
+			return nil
+		}
+		meta := readSearchMeta(metaB)
+		if meta.Docs == 0 {
+			return nil
+		}
+		avgLength := float64(meta.TotalLength) / float64(meta.Docs)
+		lengths := make(map[int]int)
+		docLength := func(id int) int {
+			if l, ok := lengths[id]; ok {
+				return l
+			}
+			var doc indexedDoc
+			json.Unmarshal(docsB.Get(idKey(id)), &doc)
+			lengths[id] = doc.Length
+			return doc.Length
+		}
+
+		for i, qt := range qterms {
+			qt.expand(termsB)
+			termScores := make(map[int]float64)
+			for term, weight := range qt.matches {
+				postings, err := decodePostings(termsB.Get([]byte(term)))
+				if err != nil {
+					return fmt.Errorf("%s: %s", term, err)
+				}
+				idf := math.Log(1 + (float64(meta.Docs)-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+				for id, tf := range postings {
+					norm := bm25K1 * (1 - bm25B + bm25B*float64(docLength(id))/avgLength)
+					score := weight * idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + norm)
+					// Several expansions of a prefix only count once, the best
+					if score > termScores[id] {
+						termScores[id] = score
+					}
+				}
+			}
+
+			// Every term has to match
+			if i == 0 {
+				scores = termScores
+				continue
+			}
+			for id := range scores {
+				if s, ok := termScores[id]; ok {
+					scores[id] += s
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	total := len(ids)
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	ids = ids[offset:]
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	results := make([]SearchResult, 0, len(ids))
+	for _, id := range ids {
+		var data Data
+		if err := db.One("ID", id, &data); err != nil {
+			logger.Warn("Entry is indexed but can't be read", "id", id, "error", err)
+			continue
+		}
+		results = append(results, SearchResult{
+			Score: math.Round(scores[id]*1000) / 1000,
+			Item:  data,
+			Highlights: map[string]string{
+				"title":       highlight(data.Title, qterms, 0),
+				"description": highlight(data.Description, qterms, snippetWords),
+			},
+		})
+	}
+	return total, results, nil
+}
+
+// Wraps the words of text matching the query in <mark>. With a window,
+// only that many words around the first match are kept. Crawled text can
+// hold anything, so the rest is HTML escaped and only the <mark>s are markup.
+func highlight(text string, qterms []*queryTerm, window int) string {
+	tokens := tokenize(text)
+	matched := make([]bool, len(tokens))
+	first := -1
+	for i, t := range tokens {
+		for _, qt := range qterms {
+			if _, ok := qt.matches[stem(t.word)]; ok || (qt.prefix && strings.HasPrefix(t.word, qt.word)) {
+				matched[i] = true
+				if first < 0 {
+					first = i
+				}
+				break
+			}
+		}
+	}
+
+	from, to := 0, len(tokens)
+	if window > 0 && len(tokens) > window {
+		if first < 0 {
+			first = 0
+		}
+		from = first - window/3
+		if from < 0 {
+			from = 0
+		}
+		to = from + window
+		if to > len(tokens) {
+			to, from = len(tokens), len(tokens)-window
+		}
+	}
+	if len(tokens) == 0 {
+		return html.EscapeString(text)
+	}
+
+	var b strings.Builder
+	start, end := 0, len(text)
+	if from > 0 {
+		start = tokens[from].start
+		b.WriteString("…")
+	}
+	if to < len(tokens) {
+		end = tokens[to-1].end
+	}
+	last := start
+	for i := from; i < to; i++ {
+		if !matched[i] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:tokens[i].start]))
+		b.WriteString("<mark>" + html.EscapeString(text[tokens[i].start:tokens[i].end]) + "</mark>")
+		last = tokens[i].end
+	}
+	b.WriteString(html.EscapeString(text[last:end]))
+	if to < len(tokens) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// Full-text search over the title and description of the entries
+func (e *Env) searchJSON(c *gin.Context) {
+	query := c.Query("q")
+	if strings.TrimSpace(query) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Give something to search for with ?q= ! X( "})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultSearchLimit)))
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("limit should be between 1 and %d", maxSearchLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "offset should be a positive number"})
+		return
+	}
+
+	total, results, err := search(e.db, query, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "results": results})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asdine/storm"
+)
+
+// A migrated, empty foli.db in a temporary directory
+func newTestDB(t *testing.T) *storm.DB {
+	db, err := storm.Open(filepath.Join(t.TempDir(), "foli.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db, latestSchemaVersion(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSearchIndex(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word, want string
+	}{
+		{"sketch", "sketch"},
+		{"sketches", "sketch"},
+		{"sketching", "sketch"},
+		{"sketched", "sketch"},
+		{"boxes", "box"},
+		{"brushes", "brush"},
+		{"classes", "class"},
+		{"class", "class"},
+		{"notebooks", "notebook"},
+		{"stories", "story"},
+		{"cache", "cach"},
+		{"caches", "cach"},
+		{"cached", "cach"},
+		{"running", "run"},
+		{"branding", "brand"},
+		{"illustration", "illustr"},
+		{"campus", "campus"},
+		{"gas", "gas"},
+	}
+	for _, tt := range tests {
+		if got := stem(tt.word); got != tt.want {
+			t.Errorf("stem(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestDecodePostings(t *testing.T) {
+	postings := map[int]int{1: 3, 300: 1, 70000: 12}
+	got, err := decodePostings(encodePostings(postings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(postings) {
+		t.Fatalf("decoded %v, want %v", got, postings)
+	}
+	for id, tf := range postings {
+		if got[id] != tf {
+			t.Errorf("decoded %v, want %v", got, postings)
+		}
+	}
+
+	for _, b := range [][]byte{
+		{0x80},       // cut in the middle of an ID
+		{0x01},       // ID without its frequency
+		{0x01, 0x80}, // cut in the middle of a frequency
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // overflows
+	} {
+		if _, err := decodePostings(b); err != errCorruptPostings {
+			t.Errorf("decodePostings(%x): err = %v, want errCorruptPostings", b, err)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	db := newTestDB(t)
+	for i, data := range []Data{
+		{Title: "Weekly notes", Description: "A long description of the week, with a sketch somewhere in the middle of many other words about design and type and colour."},
+		{Title: "Sketches", Description: "Pencil sketches of birds."},
+		{Title: "Poster", Description: "Typography only."},
+		{Title: "Sketch notebook", Description: "Notebooks full of drawings."},
+	} {
+		data.Provider, data.UpstreamID, data.Src = "test", string(rune('a'+i)), "http://example.com/"+string(rune('a'+i))
+		if err := upsert(db, &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// In the title and twice in the description beats once in the
+		// title, which beats once in a long description
+		{"sketch", []string{"Sketches", "Sketch notebook", "Weekly notes"}},
+		{"sketches", []string{"Sketches", "Sketch notebook", "Weekly notes"}},
+		// Every word has to match
+		{"sketch notebook", []string{"Sketch notebook"}},
+		{"typography", []string{"Poster"}},
+		{"watercolour", nil},
+	}
+	for _, tt := range tests {
+		total, results, err := search(db, tt.query, 10, 0)
+		if err != nil {
+			t.Fatalf("search(%q): %s", tt.query, err)
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.Item.Title)
+		}
+		if total != len(tt.want) || strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+			t.Errorf("search(%q) = %d %v, want %v", tt.query, total, got, tt.want)
+		}
+		for i := 1; i < len(results); i++ {
+			if results[i].Score > results[i-1].Score {
+				t.Errorf("search(%q): results aren't sorted by score", tt.query)
+			}
+		}
+	}
+}
+
+func TestHighlightEscapes(t *testing.T) {
+	qterms := parseSearchQuery("onerror")
+	qterms[0].matches = map[string]float64{stem("onerror"): 1}
+
+	got := highlight(`<img src=x onerror=alert(1)> & "more"`, qterms, 0)
+	want := `&lt;img src=x <mark>onerror</mark>=alert(1)&gt; &amp; &#34;more&#34;`
+	if got != want {
+		t.Errorf("highlight = %s, want %s", got, want)
+	}
+	if got := highlight("<b>", nil, 0); got != "&lt;b&gt;" {
+		t.Errorf("highlight without words = %s, want &lt;b&gt;", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Query parameters whose values are secrets, masked whenever a URL is logged
+// or kept in an error
+var secretParams = []string{"client_id", "api_key", "access_token", "X-Amz-Credential", "X-Amz-Signature"}
+
+// Shows just enough of a secret to tell which one is used
+func maskSecret(secret string) string {
+	if len(secret) < 12 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// rawurl with the values of secretParams masked
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.RawQuery == "" {
+		return rawurl
+	}
+	query := u.Query()
+	changed := false
+	for _, param := range secretParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "REDACTED")
+			changed = true
+		}
+	}
+	if !changed {
+		return rawurl
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Errors of net/http carry the URL they were about
+func redactError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: urlErr.Op, URL: redactURL(urlErr.URL), Err: urlErr.Err}
+	}
+	return err
+}
+
+// The secrets loaded from the config, see redactingWriter
+var secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// Registers secret once, however many times the config is reloaded. Those
+// replaced by a reload stay masked.
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, known := range secrets.values {
+		if known == secret {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, secret)
+}
+
+// redactingWriter masks every registered secret written through it, so a
+// secret that slips into a log line still doesn't leave the process.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	secrets.mu.RLock()
+	out := p
+	for _, secret := range secrets.values {
+		if bytes.Contains(out, []byte(secret)) {
+			out = bytes.Replace(out, []byte(secret), []byte(maskSecret(secret)), -1)
+		}
+	}
+	secrets.mu.RUnlock()
+
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Reads a secret from a file, e.g. a mounted Kubernetes or Docker secret,
+// without the trailing newline editors add
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegisterSecretOnce(t *testing.T) {
+	secret := "test-secret-for-reloads"
+	for i := 0; i < 3; i++ {
+		// Like every reload of the config does
+		registerSecret(secret)
+	}
+	n := 0
+	secrets.mu.RLock()
+	for _, known := range secrets.values {
+		if known == secret {
+			n++
+		}
+	}
+	secrets.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("registered %d times, want once", n)
+	}
+
+	var buf bytes.Buffer
+	redactingWriter{&buf}.Write([]byte("key=" + secret))
+	if want := "key=" + maskSecret(secret); buf.String() != want {
+		t.Errorf("wrote %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// Stats sums up what foli.db holds, see foli stats
+type Stats struct {
+	Entries    int            `json:"entries"`
+	ByProvider map[string]int `json:"by_provider"`
+	Curated    int            `json:"curated"`
+	// Distinct covers and the bytes they take
+	Covers     int   `json:"covers"`
+	CoverBytes int64 `json:"cover_bytes"`
+	DBBytes    int64 `json:"db_bytes"`
+	Schema     int   `json:"schema_version"`
+	// Crawls that were interrupted, by provider
+	Checkpoints map[string]Checkpoint `json:"checkpoints"`
+}
+
+func collectStats(db *storm.DB) (Stats, error) {
+	stats := Stats{ByProvider: make(map[string]int), Checkpoints: make(map[string]Checkpoint)}
+	covers := make(map[string]bool)
+
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		stats.DBBytes = tx.Size()
+		node := db.WithTransaction(tx)
+
+		var err error
+		if stats.Schema, err = schemaVersion(node); err != nil {
+			return err
+		}
+
+		err = node.Select().Each(new(Data), func(record interface{}) error {
+			data := record.(*Data)
+			stats.Entries++
+			provider := data.Provider
+			if provider == "" {
+				provider = "unknown"
+			}
+			stats.ByProvider[provider]++
+			if data.Curated {
+				stats.Curated++
+			}
+			if data.Hash != "" && !covers[data.Hash] {
+				covers[data.Hash] = true
+				stats.CoverBytes += data.Size
+			}
+			return nil
+		})
+		if err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		stats.Covers = len(covers)
+
+		b := tx.Bucket([]byte(checkpointBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			// Nested buckets, like storm's metadata
+			if v == nil {
+				return nil
+			}
+			var cp Checkpoint
+			if err := json.Unmarshal(v, &cp); err != nil {
+				return err
+			}
+			if cp.Page > 0 {
+				stats.Checkpoints[string(k)] = cp
+			}
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// foli stats [-json]
+func statsCommand(cfg *Config, args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the stats as JSON")
+	flags.Parse(args)
+
+	db := openDB(cfg)
+	defer db.Close()
+	stats, err := collectStats(db)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		enc.Encode(stats)
+		return
+	}
+
+	fmt.Printf("Database      %s, %s, schema version %d of %d\n", cfg.DB, humanBytes(stats.DBBytes), stats.Schema, latestSchemaVersion())
+	fmt.Printf("Entries       %d, %d curated\n", stats.Entries, stats.Curated)
+	providers := make([]string, 0, len(stats.ByProvider))
+	for provider := range stats.ByProvider {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	for _, provider := range providers {
+		fmt.Printf("  %-11s %d\n", provider, stats.ByProvider[provider])
+	}
+	fmt.Printf("Covers        %d, %s\n", stats.Covers, humanBytes(stats.CoverBytes))
+	for provider, cp := range stats.Checkpoints {
+		fmt.Printf("Crawl of %s stopped at page %d, resumes after creator %s\n", provider, cp.Page, cp.Creator)
+	}
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
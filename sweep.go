@@ -0,0 +1,163 @@
+package main
+
+import (
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
+)
+
+// Bucket of the covers no entry uses anymore, by hash, with when the last
+// entry let go of them. The sweep deletes their blobs.
+const orphanBucket = "orphans"
+
+// How long a cover stays orphaned before its blob is deleted. A download
+// takes far less between storing its blob and saving its entry.
+const orphanGrace = time.Hour
+
+// How often serve sweeps
+const sweepInterval = 10 * time.Minute
+
+// Marks the cover of hash as orphaned if no entry uses it anymore. It's
+// called in the transaction that dropped the last entry using it, so a crawl
+// can't add one in between.
+func releaseCover(tx storm.Node, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	var users []Data
+	err := tx.Find("Hash", hash, &users)
+	if err == storm.ErrNotFound {
+		return tx.Set(orphanBucket, hash, time.Now())
+	}
+	return err
+}
+
+// Saving an entry with a cover takes it back from the sweep
+func keepCover(tx storm.Node, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	err := tx.Delete(orphanBucket, hash)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Takes the cover of hash back from the sweep before a download looks for
+// its blob, so a sweep doesn't delete it after the download found it there.
+// Sweeps delete blobs in their transaction, a blob found after this one is
+// there to stay.
+func claimCover(db *storm.DB, hash string) error {
+	var orphaned time.Time
+	err := db.Get(orphanBucket, hash, &orphaned)
+	if err == storm.ErrNotFound {
+		// Orphaned from now on, it's the grace that keeps it until the
+		// download saves its entry
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return db.Bolt.Update(func(tx *bolt.Tx) error {
+		return keepCover(db.WithTransaction(tx), hash)
+	})
+}
+
+// Deletes the blobs of the covers orphaned before the grace. Each one is
+// deleted in its own transaction, which checks again that no entry uses it.
+func sweepCovers(db *storm.DB, store BlobStore) (int, error) {
+	var hashes []string
+	err := db.Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(orphanBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			hashes = append(hashes, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, hash := range hashes {
+		err := db.Bolt.Update(func(btx *bolt.Tx) error {
+			tx := db.WithTransaction(btx)
+			var orphaned time.Time
+			if err := tx.Get(orphanBucket, hash, &orphaned); err != nil {
+				// Claimed since
+				if err == storm.ErrNotFound {
+					return nil
+				}
+				return err
+			}
+			if time.Since(orphaned) < orphanGrace {
+				return nil
+			}
+			var users []Data
+			err := tx.Find("Hash", hash, &users)
+			if err == nil {
+				return keepCover(tx, hash)
+			}
+			if err != storm.ErrNotFound {
+				return err
+			}
+			// Still in the transaction, a download claiming it waits for
+			// the blob to be gone and stores it again
+			if err := store.Delete(blobKey(hash)); err != nil {
+				return err
+			}
+			deleted++
+			return keepCover(tx, hash)
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// Sweeper runs sweepCovers in the background
+type Sweeper struct {
+	db    *storm.DB
+	store BlobStore
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewSweeper(db *storm.DB, store BlobStore) *Sweeper {
+	return &Sweeper{db: db, store: store, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Sweeps every sweepInterval until Stop
+func (s *Sweeper) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := sweepCovers(s.db, s.store)
+				if err != nil {
+					logger.Error("Sweeping covers failed, the next sweep tries again", "error", err)
+				}
+				if deleted > 0 {
+					logger.Info("Deleted the covers no entry uses", "covers", deleted)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops sweeping and waits for a sweep going on, so foli.db can be closed
+func (s *Sweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
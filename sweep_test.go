@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+func putBlob(t *testing.T, store BlobStore, hash string) {
+	if err := store.Put(blobKey(hash), strings.NewReader(hash), int64(len(hash)), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func blobExists(t *testing.T, store BlobStore, hash string) bool {
+	exists, err := store.Exists(blobKey(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func orphaned(t *testing.T, db *storm.DB, hash string) bool {
+	var at time.Time
+	err := db.Get(orphanBucket, hash, &at)
+	if err != nil && err != storm.ErrNotFound {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+// Makes the cover look orphaned for longer than the grace
+func ageOrphan(t *testing.T, db *storm.DB, hash string) {
+	if err := db.Set(orphanBucket, hash, time.Now().Add(-2*orphanGrace)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpsertReleasesCovers(t *testing.T) {
+	db := newTestDB(t)
+	crawled := func(src, hash string) *Data {
+		return &Data{Title: "Upstream", Provider: "test", UpstreamID: "1", Src: src, Hash: hash}
+	}
+
+	if err := upsert(db, crawled("http://example.com/a.png", "aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	// Upstream changed its cover
+	if err := upsert(db, crawled("http://example.com/b.png", "bbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if !orphaned(t, db, "aaaa") || orphaned(t, db, "bbbb") {
+		t.Fatal("the replaced cover should be orphaned, not the new one")
+	}
+	// And changed it back before the sweep
+	if err := upsert(db, crawled("http://example.com/a.png", "aaaa")); err != nil {
+		t.Fatal(err)
+	}
+	if orphaned(t, db, "aaaa") || !orphaned(t, db, "bbbb") {
+		t.Fatal("the cover in use again shouldn't be orphaned")
+	}
+
+	// A curator picked another cover, crawls keep it
+	var row Data
+	if err := db.One("UpstreamKey", upstreamKey("test", "1"), &row); err != nil {
+		t.Fatal(err)
+	}
+	row.Title, row.Src, row.Filename, row.Hash, row.Curated = "Curated", "http://example.com/c.png", "c.png", "cccc", true
+	if err := db.Save(&row); err != nil {
+		t.Fatal(err)
+	}
+	if err := upsert(db, crawled("http://example.com/d.png", "dddd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.One("ID", row.ID, &row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Title != "Curated" || row.Src != "http://example.com/c.png" || row.Filename != "c.png" || row.Hash != "cccc" {
+		t.Errorf("the crawl overwrote the curated row: %+v", row)
+	}
+	if !orphaned(t, db, "dddd") {
+		t.Error("the cover the crawl downloaded for nothing should be orphaned")
+	}
+}
+
+func TestSweepCovers(t *testing.T) {
+	db := newTestDB(t)
+	store := NewLocalStore(t.TempDir())
+	for _, hash := range []string{"aaaa", "bbbb", "cccc"} {
+		putBlob(t, store, hash)
+	}
+	if err := upsert(db, &Data{Provider: "test", UpstreamID: "1", Src: "http://example.com/a.png", Hash: "aaaa"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Released just now, it's kept for the grace
+	for _, hash := range []string{"bbbb", "cccc"} {
+		if err := db.Set(orphanBucket, hash, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deleted, err := sweepCovers(db, store); err != nil || deleted != 0 {
+		t.Fatalf("sweep in the grace deleted %d, %v, want 0", deleted, err)
+	}
+
+	// A download found it again
+	ageOrphan(t, db, "cccc")
+	if err := claimCover(db, "cccc"); err != nil {
+		t.Fatal(err)
+	}
+	// An entry uses it, the orphan mark is stale
+	ageOrphan(t, db, "aaaa")
+	ageOrphan(t, db, "bbbb")
+
+	deleted, err := sweepCovers(db, store)
+	if err != nil || deleted != 1 {
+		t.Fatalf("sweep deleted %d, %v, want 1", deleted, err)
+	}
+	if !blobExists(t, store, "aaaa") || blobExists(t, store, "bbbb") || !blobExists(t, store, "cccc") {
+		t.Error("only the orphaned cover no download claimed should be deleted")
+	}
+	for _, hash := range []string{"aaaa", "bbbb", "cccc"} {
+		if orphaned(t, db, hash) {
+			t.Errorf("%s is still marked orphaned after the sweep", hash)
+		}
+	}
+}
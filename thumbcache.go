@@ -0,0 +1,136 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where thumbnails are cached and how much disk they may take, unless
+// THUMB_CACHE_DIR and THUMB_CACHE_SIZE (in MB) say otherwise
+var defaultThumbCacheDir = filepath.Join(".", "cache")
+
+const defaultThumbCacheMB = 256
+
+// ThumbCache keeps generated thumbnails on disk, evicting the least recently
+// used ones once they take more than the budget. The recency order lives in
+// memory and is rebuilt from the file modification times on startup, a hit
+// touches its file so the order survives restarts.
+type ThumbCache struct {
+	dir    string
+	budget int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+type thumbEntry struct {
+	key  string
+	size int64
+}
+
+func NewThumbCache(dir string, budget int64) (*ThumbCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	c := &ThumbCache{
+		dir:     dir,
+		budget:  budget,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first, each one pushed to the front
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, f := range files {
+		if f.IsDir() || f.Name()[0] == '.' {
+			continue
+		}
+		c.entries[f.Name()] = c.order.PushFront(&thumbEntry{key: f.Name(), size: f.Size()})
+		c.size += f.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// The cached thumbnail for key, ok is false on a miss. The file is opened
+// under the lock, so an eviction can't remove it before it's served, the
+// caller closes it.
+func (c *ThumbCache) Get(key string) (f *os.File, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	path := filepath.Join(c.dir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		// Gone behind our back, it's made again
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.size -= el.Value.(*thumbEntry).size
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, true
+}
+
+// Stores data under key, then evicts until the cache fits its budget again
+func (c *ThumbCache) Put(key string, data []byte) error {
+	tmp, err := ioutil.TempFile(c.dir, ".thumb-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, key)); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(*thumbEntry).size
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&thumbEntry{key: key, size: int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// Callers hold c.mu
+func (c *ThumbCache) evict() {
+	for c.size > c.budget && c.order.Len() > 0 {
+		el := c.order.Back()
+		entry := el.Value.(*thumbEntry)
+		if err := os.Remove(filepath.Join(c.dir, entry.key)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Can't evict the thumbnail", "key", entry.key, "error", err)
+		}
+		c.order.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbCacheGetSurvivesEviction(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewThumbCache(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("a", []byte("aaaaaaaa")); err != nil {
+		t.Fatal(err)
+	}
+	f, ok := c.Get("a")
+	if !ok {
+		t.Fatal("a missed")
+	}
+	defer f.Close()
+
+	// Evicts a while it's being served
+	if err := c.Put("b", []byte("bbbbbbbb")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != "aaaaaaaa" {
+		t.Errorf("served %q, %v, want aaaaaaaa", got, err)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("a is still cached after its eviction")
+	}
+
+	// Removed behind the cache's back, it's a miss
+	if err := os.Remove(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("b hit without its file")
+	}
+	if c.size != 0 || len(c.entries) != 0 {
+		t.Errorf("%d bytes in %d entries left, want none", c.size, len(c.entries))
+	}
+}